@@ -0,0 +1,72 @@
+package main
+
+import (
+	"./proxy"
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type credentialKey struct{}
+
+// credential returns the credential authMiddleware found on the request, nil if authentication is off
+func credential(req *http.Request) *proxy.Credential {
+	cred, _ := req.Context().Value(credentialKey{}).(*proxy.Credential)
+	return cred
+}
+
+// Subprotocol prefixes with which browsers, which cannot set headers on a WebSocket
+// handshake, send their credentials
+const (
+	wsBearerPrefix = "bearer."
+	wsAPIKeyPrefix = "apikey."
+)
+
+// webSocketCredentials moves credentials offered as WebSocket subprotocols to the headers
+// the authenticators read, unless those are set
+func webSocketCredentials(req *http.Request) {
+	if !websocket.IsWebSocketUpgrade(req) {
+		return
+	}
+	for _, protocol := range websocket.Subprotocols(req) {
+		switch {
+		case strings.HasPrefix(protocol, wsBearerPrefix) && req.Header.Get("Authorization") == "":
+			req.Header.Set("Authorization", "Bearer "+strings.TrimPrefix(protocol, wsBearerPrefix))
+		case strings.HasPrefix(protocol, wsAPIKeyPrefix) && req.Header.Get(proxy.APIKeyHeader) == "":
+			req.Header.Set(proxy.APIKeyHeader, strings.TrimPrefix(protocol, wsAPIKeyPrefix))
+		}
+	}
+}
+
+// authMiddleware rejects requests without a valid credential, and requests for
+// /nodes/{id}/* and /request/{id} from anyone but the node's owner or an admin
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/openapi.json" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		webSocketCredentials(req)
+		cred, err := proxy.Authenticate(req)
+		if err != nil {
+			log.Println(err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gilmour-proxy"`)
+			writeJSON(w, http.StatusUnauthorized, errorResponse{err.Error()})
+			return
+		}
+		if id, ok := mux.Vars(req)["id"]; ok {
+			// Unknown nodes are left to the handler, which answers 404
+			if node, err := getNode(id); err == nil {
+				if err = node.Authorize(cred); err != nil {
+					log.Println(cred.Principal, "denied node", id)
+					writeJSON(w, http.StatusForbidden, errorResponse{err.Error()})
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), credentialKey{}, cred)))
+	})
+}
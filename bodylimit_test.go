@@ -0,0 +1,57 @@
+package main
+
+import (
+	"./proxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	defer proxy.SetBodyLimits(proxy.GetBodyLimits())
+	proxy.SetBodyLimits(proxy.BodyLimits{Control: 10, Publish: 20})
+	var received string
+	handler := bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received = string(body)
+	}))
+
+	for _, tc := range []struct {
+		path    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"/nodes", strings.Repeat("a", 10), false, http.StatusOK},
+		{"/nodes", strings.Repeat("a", 11), false, http.StatusRequestEntityTooLarge},
+		{"/nodes", strings.Repeat("a", 11), true, http.StatusRequestEntityTooLarge},
+		{"/request/n1", strings.Repeat("a", 20), false, http.StatusOK},
+		{"/v1/request/n1", strings.Repeat("a", 20), true, http.StatusOK},
+		{"/request/n1", strings.Repeat("a", 21), false, http.StatusRequestEntityTooLarge},
+		{"/v1/request/n1", strings.Repeat("a", 21), true, http.StatusRequestEntityTooLarge},
+	} {
+		received = ""
+		var body io.Reader = strings.NewReader(tc.body)
+		if tc.chunked {
+			body = ioutil.NopCloser(body) // hides the length, as a chunked body would
+		}
+		req := httptest.NewRequest("POST", tc.path, body)
+		if tc.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s with %d bytes (chunked %v): status = %d", tc.path, len(tc.body), tc.chunked, w.Code)
+		}
+		if tc.status == http.StatusOK && received != tc.body {
+			t.Errorf("%s: handler read %q", tc.path, received)
+		}
+		if tc.status != http.StatusOK && received != "" {
+			t.Errorf("%s: handler was called with an oversized body", tc.path)
+		}
+	}
+}
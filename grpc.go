@@ -0,0 +1,549 @@
+package main
+
+import (
+	"./proxy"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// grpcServiceName is the full name of the gRPC service
+const grpcServiceName = "gilmour.proxy.v1.Proxy"
+
+// grpcMessage is a received message which keeps the bytes it was sent as, for the
+// HMAC signature of the call to cover them
+type grpcMessage struct {
+	raw []byte
+	v   interface{}
+}
+
+// unwrap returns the value to decode data into, keeping data if v is a grpcMessage
+func unwrap(data []byte, v interface{}) interface{} {
+	if m, ok := v.(*grpcMessage); ok {
+		m.raw = append([]byte(nil), data...)
+		return m.v
+	}
+	return v
+}
+
+// jsonCodec lets gRPC clients send the same JSON bodies as the HTTP API.
+// Clients select it with the content subtype "json" (content-type application/grpc+json).
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (jsonCodec) Name() string                          { return "json" }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, unwrap(data, v))
+}
+
+// structCodec replaces gRPC's default protobuf codec. Clients generated from proxy.proto
+// send and receive google.protobuf.Struct messages holding the fields of the JSON bodies.
+// Other protobuf messages are left to the default codec.
+type structCodec struct {
+	encoding.Codec
+}
+
+func (c structCodec) Marshal(v interface{}) ([]byte, error) {
+	if _, ok := v.(proto.Message); ok {
+		return c.Codec.Marshal(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(structpb.Struct)
+	if err = protojson.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+func (c structCodec) Unmarshal(data []byte, v interface{}) error {
+	if _, ok := v.(proto.Message); ok {
+		return c.Codec.Unmarshal(data, v)
+	}
+	msg := new(structpb.Struct)
+	err := proto.Unmarshal(data, msg)
+	if err == nil && len(msg.ProtoReflect().GetUnknown()) > 0 {
+		err = errors.New("unknown fields")
+	}
+	if err != nil {
+		return errors.New("messages must be google.protobuf.Struct, see proxy.proto: " + err.Error())
+	}
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, unwrap(data, v))
+}
+
+// Codecs must be registered during initialization. gRPC's own protobuf codec is
+// registered by the grpc package, which is initialized first.
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+	encoding.RegisterCodec(structCodec{encoding.GetCodec("proto")})
+}
+
+// gRPC request bodies. Responses are the same as for the HTTP API.
+type grpcNodeRef struct {
+	ID string `json:"id"`
+}
+
+type grpcDeleteRequest struct {
+	ID      string `json:"id"`
+	Force   bool   `json:"force"`
+	Timeout string `json:"timeout"`
+}
+
+type grpcServices struct {
+	ID       string            `json:"id"`
+	Services proxy.ServiceList `json:"services"`
+}
+
+type grpcSlots struct {
+	ID    string         `json:"id"`
+	Slots proxy.SlotList `json:"slots"`
+}
+
+type grpcRemove struct {
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+	Path  string `json:"path"`
+}
+
+type grpcPublish struct {
+	ID string `json:"id"`
+	proxy.Request
+}
+
+type grpcAsyncRef struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+}
+
+type grpcSignalRequest struct {
+	ID    string      `json:"id"`
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+type signalResponse struct {
+	Sender string `json:"sender"`
+}
+
+// grpcError converts errors from the proxy package to gRPC statuses,
+// matching the HTTP status codes of the same errors
+func grpcError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case proxy.ValidationErrors:
+		return status.Error(codes.InvalidArgument, e.Error())
+	case proxy.PolicyDenied:
+		return status.Error(codes.PermissionDenied, e.Error())
+	case proxy.RateLimitError:
+		return status.Error(codes.ResourceExhausted, e.Error())
+	}
+	switch err {
+	case proxy.ErrUnauthenticated:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case proxy.ErrForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case proxy.ErrServiceNotFound, proxy.ErrRequestNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case proxy.ErrTooManyAsync:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// grpcAuthenticate runs the HTTP authenticators on the call's metadata. HMAC signatures
+// cover the method "POST", the full gRPC method name and body, the request message as sent.
+func grpcAuthenticate(ctx context.Context, method string, body []byte) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	req := &http.Request{Method: "POST", URL: &url.URL{Path: method}, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+	for key, values := range md {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	cred, err := proxy.Authenticate(req)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return context.WithValue(ctx, credentialKey{}, cred), nil
+}
+
+// decodeError reports a request message which could not be decoded as InvalidArgument,
+// where gRPC reports it as Internal
+func decodeError(err error) error {
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Internal {
+		return status.Error(codes.InvalidArgument, s.Message())
+	}
+	return err
+}
+
+func grpcCredential(ctx context.Context) *proxy.Credential {
+	cred, _ := ctx.Value(credentialKey{}).(*proxy.Credential)
+	return cred
+}
+
+// grpcNode returns the node with id, if the caller may use it
+func grpcNode(ctx context.Context, id string) (*proxy.Node, error) {
+	node, err := getNode(id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err = node.Authorize(grpcCredential(ctx)); err != nil {
+		return nil, grpcError(err)
+	}
+	return node, nil
+}
+
+// credentialStream authenticates a stream with its first message, which the HMAC
+// signature covers. Handlers get the context with the caller's credential after it.
+type credentialStream struct {
+	grpc.ServerStream
+	method  string
+	ctx     context.Context
+	authErr error
+}
+
+func (s *credentialStream) RecvMsg(m interface{}) error {
+	if s.authErr != nil {
+		return s.authErr
+	}
+	if s.ctx != nil {
+		return s.ServerStream.RecvMsg(m)
+	}
+	msg := &grpcMessage{v: m}
+	if err := s.ServerStream.RecvMsg(msg); err != nil {
+		return decodeError(err)
+	}
+	s.ctx, s.authErr = grpcAuthenticate(s.ServerStream.Context(), s.method, msg.raw)
+	return s.authErr
+}
+
+func (s *credentialStream) Context() context.Context {
+	if s.ctx == nil {
+		return s.ServerStream.Context()
+	}
+	return s.ctx
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	msg := req.(*grpcMessage)
+	ctx, err := grpcAuthenticate(ctx, info.FullMethod, msg.raw)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, msg)
+}
+
+func grpcStreamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	s := &credentialStream{ServerStream: stream, method: info.FullMethod}
+	err := handler(srv, s)
+	if s.authErr != nil {
+		return s.authErr
+	}
+	return err
+}
+
+// unaryMethod describes a unary gRPC method which decodes its request into newReq()
+func unaryMethod(name string, newReq func() interface{}, call grpc.UnaryHandler) grpc.MethodDesc {
+	unwrapped := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return call(ctx, req.(*grpcMessage).v)
+	}
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &grpcMessage{v: newReq()}
+			if err := dec(req); err != nil {
+				return nil, decodeError(err)
+			}
+			if interceptor == nil {
+				return unwrapped(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/" + name}
+			return interceptor(ctx, req, info, unwrapped)
+		},
+	}
+}
+
+// grpcCreateNode registers an HTTP node when the request has a port, url or socket,
+// and otherwise a node which receives its dispatches on the Connect stream
+func grpcCreateNode(ctx context.Context, req interface{}) (interface{}, error) {
+	nodeReq := req.(*proxy.NodeReq)
+	engine, err := proxy.MakeGilmour(redisAddr)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	var node *proxy.Node
+	if nodeReq.Port == "" && nodeReq.URL == "" && nodeReq.Socket == "" {
+		node, err = proxy.CreateChannelNode(nodeReq, engine, proxy.TransportGRPC)
+	} else if err = nodeReq.Validate(); err == nil {
+		node, err = proxy.CreateNode(nodeReq, engine)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err = startNode(node, grpcCredential(ctx)); err != nil {
+		return nil, grpcError(err)
+	}
+	return node.FormatResponseV1(), nil
+}
+
+func grpcGetNode(ctx context.Context, req interface{}) (interface{}, error) {
+	node, err := grpcNode(ctx, req.(*grpcNodeRef).ID)
+	if err != nil {
+		return nil, err
+	}
+	return node.DetailsV1(), nil
+}
+
+func grpcDeleteNode(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcDeleteRequest)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 30 * time.Second
+	if r.Timeout != "" {
+		if timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return proxy.DeleteNode(node, r.Force, timeout), nil
+}
+
+// grpcSubscriptionResults answers a bulk add like writeSubscriptionResults: only invalid
+// requests fail, other errors are reported in the status and results
+func grpcSubscriptionResults(results []proxy.SubscriptionResult, err error) (interface{}, error) {
+	if verr, ok := err.(proxy.ValidationErrors); ok {
+		return nil, grpcError(verr)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return subscriptionResponse{Status: setResponseStatus(err), Results: results}, nil
+}
+
+func grpcAddServices(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcServices)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return grpcSubscriptionResults(node.SubscribeServices(r.Services))
+}
+
+func grpcGetServices(ctx context.Context, req interface{}) (interface{}, error) {
+	node, err := grpcNode(ctx, req.(*grpcNodeRef).ID)
+	if err != nil {
+		return nil, err
+	}
+	services, err := node.GetServices()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return servicesResponse{Services: services}, nil
+}
+
+func grpcRemoveServices(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcRemove)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := node.RemoveServices(proxy.GilmourTopic(r.Topic), r.Path)
+	if err == proxy.ErrServiceNotFound {
+		return nil, grpcError(err)
+	}
+	return removeResponse{Status: setResponseStatus(err), Removed: len(removed)}, nil
+}
+
+func grpcAddSlots(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcSlots)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return grpcSubscriptionResults(node.SubscribeSlots(r.Slots))
+}
+
+func grpcGetSlots(ctx context.Context, req interface{}) (interface{}, error) {
+	node, err := grpcNode(ctx, req.(*grpcNodeRef).ID)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := node.GetSlots()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return slotsResponse{Slots: slots}, nil
+}
+
+func grpcRemoveSlots(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcRemove)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = node.RemoveSlot(proxy.Slot{Topic: r.Topic, Path: r.Path})
+	return statusResponse{Status: setResponseStatus(err)}, nil
+}
+
+// grpcRequest answers with the response, or with the proxy.AsyncRequest for async requests
+func grpcRequest(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcPublish)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err = node.AllowPublish(r.Topics()...); err != nil {
+		return nil, grpcError(err)
+	}
+	if r.Async {
+		ar, err := node.RequestServiceAsync(r.Request)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return ar, nil
+	}
+	return node.RequestService(r.Request), nil
+}
+
+func grpcGetRequest(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcAsyncRef)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	ar, err := node.GetAsyncRequest(r.RequestID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return ar, nil
+}
+
+func grpcSignal(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*grpcSignalRequest)
+	node, err := grpcNode(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err = node.AllowPublish(r.Topic); err != nil {
+		return nil, grpcError(err)
+	}
+	sender, err := node.PublishSignal(r.Topic, r.Data)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return signalResponse{Sender: sender}, nil
+}
+
+// grpcRequestStream sends each response message as it is received, then a streamSummary
+func grpcRequestStream(srv interface{}, stream grpc.ServerStream) error {
+	r := new(grpcPublish)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	node, err := grpcNode(stream.Context(), r.ID)
+	if err != nil {
+		return err
+	}
+	if err = node.AllowPublish(r.Topics()...); err != nil {
+		return grpcError(err)
+	}
+	response := node.RequestServiceStream(r.Request, func(m proxy.RequestResponseMessage) {
+		if err := stream.SendMsg(m); err != nil {
+			log.Println(err.Error())
+		}
+	})
+	return stream.SendMsg(streamSummary{Done: true, Code: response.Code, Length: response.Length})
+}
+
+// firstFrameStream hands a frame which was already received to the first RecvMsg
+type firstFrameStream struct {
+	grpc.ServerStream
+	first *proxy.Frame
+}
+
+func (s *firstFrameStream) RecvMsg(m interface{}) error {
+	if s.first == nil {
+		return s.ServerStream.RecvMsg(m)
+	}
+	*m.(*proxy.Frame), s.first = *s.first, nil
+	return nil
+}
+
+// grpcConnect runs the node channel, as on GET /ws, over a bidirectional stream.
+// The register frame is received first, as it authenticates the stream.
+func grpcConnect(srv interface{}, stream grpc.ServerStream) error {
+	first := new(proxy.Frame)
+	if err := stream.RecvMsg(first); err != nil {
+		return err
+	}
+	cred := grpcCredential(stream.Context())
+	proxy.ServeChannel(&firstFrameStream{stream, first}, cred, registerChannelNode(proxy.TransportGRPC, cred))
+	return nil
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	// The methods are plain functions, so any server value will do
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("CreateNode", func() interface{} { return new(proxy.NodeReq) }, grpcCreateNode),
+		unaryMethod("GetNode", func() interface{} { return new(grpcNodeRef) }, grpcGetNode),
+		unaryMethod("DeleteNode", func() interface{} { return new(grpcDeleteRequest) }, grpcDeleteNode),
+		unaryMethod("AddServices", func() interface{} { return new(grpcServices) }, grpcAddServices),
+		unaryMethod("GetServices", func() interface{} { return new(grpcNodeRef) }, grpcGetServices),
+		unaryMethod("RemoveServices", func() interface{} { return new(grpcRemove) }, grpcRemoveServices),
+		unaryMethod("AddSlots", func() interface{} { return new(grpcSlots) }, grpcAddSlots),
+		unaryMethod("GetSlots", func() interface{} { return new(grpcNodeRef) }, grpcGetSlots),
+		unaryMethod("RemoveSlots", func() interface{} { return new(grpcRemove) }, grpcRemoveSlots),
+		unaryMethod("Request", func() interface{} { return new(grpcPublish) }, grpcRequest),
+		unaryMethod("GetRequest", func() interface{} { return new(grpcAsyncRef) }, grpcGetRequest),
+		unaryMethod("Signal", func() interface{} { return new(grpcSignalRequest) }, grpcSignal),
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "RequestStream", Handler: grpcRequestStream, ServerStreams: true},
+		{StreamName: "Connect", Handler: grpcConnect, ServerStreams: true, ClientStreams: true},
+	},
+}
+
+// newGRPCServer returns the gRPC server for the proxy API. With tlsConfig, it serves TLS.
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if limit := proxy.GetBodyLimits().Publish; limit > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(limit)))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&grpcServiceDesc, struct{}{})
+	return s
+}
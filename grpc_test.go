@@ -0,0 +1,126 @@
+package main
+
+import (
+	"./proxy"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveGRPC starts the gRPC API on a local port and returns a connection to it
+func serveGRPC(t *testing.T, opts ...grpc.DialOption) (*grpc.ClientConn, func()) {
+	proxy.InitNodeMap()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCServer(nil)
+	go s.Serve(lis)
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	cc, err := grpc.Dial(lis.Addr().String(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc, func() {
+		cc.Close()
+		s.Stop()
+	}
+}
+
+func TestGRPCProtobufClients(t *testing.T) {
+	cc, stop := serveGRPC(t)
+	defer stop()
+
+	created := new(structpb.Struct)
+	if err := cc.Invoke(context.Background(), "/gilmour.proxy.v1.Proxy/CreateNode", &structpb.Struct{}, created); err != nil {
+		t.Fatal(err)
+	}
+	id := created.Fields["id"].GetStringValue()
+	if id == "" {
+		t.Fatalf("CreateNode = %v", created)
+	}
+	req, _ := structpb.NewStruct(map[string]interface{}{"id": id})
+	details := new(structpb.Struct)
+	if err := cc.Invoke(context.Background(), "/gilmour.proxy.v1.Proxy/GetNode", req, details); err != nil {
+		t.Fatal(err)
+	}
+	if transport := details.Fields["transport"].GetStringValue(); transport != proxy.TransportGRPC {
+		t.Errorf("transport = %q", transport)
+	}
+
+	// Bytes which are not a Struct get a clear error
+	err := cc.Invoke(context.Background(), "/gilmour.proxy.v1.Proxy/GetNode", structpb.NewStringValue("x"), details)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("non-Struct message: %v", err)
+	}
+}
+
+func TestGRPCHMACCoversTheMessage(t *testing.T) {
+	cc, stop := serveGRPC(t, grpc.WithDefaultCallOptions(grpc.CallContentSubtype("json")))
+	defer stop()
+	keys, err := ioutil.TempFile("", "gilmour-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keys.Name())
+	keys.WriteString("ops s3cret admin\n")
+	keys.Close()
+	auth, err := proxy.NewHMACAuth(keys.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetAuthenticators(auth)
+	defer proxy.SetAuthenticators()
+
+	sign := func(method string, msg interface{}) context.Context {
+		body, _ := json.Marshal(msg)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		sig := proxy.SignRequest("s3cret", "POST", method, ts, body)
+		return metadata.AppendToOutgoingContext(context.Background(),
+			"authorization", "HMAC-SHA256 ops:"+base64.StdEncoding.EncodeToString(sig),
+			"x-signature-timestamp", ts)
+	}
+
+	method := "/gilmour.proxy.v1.Proxy/CreateNode"
+	var created proxy.CreateNodeResponseV1
+	if err := cc.Invoke(sign(method, proxy.NodeReq{}), method, proxy.NodeReq{}, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	method = "/gilmour.proxy.v1.Proxy/GetNode"
+	signed := map[string]string{"id": created.ID}
+	var details map[string]interface{}
+	ctx := sign(method, signed)
+	if err := cc.Invoke(ctx, method, signed, &details); err != nil {
+		t.Fatalf("signed call: %v", err)
+	}
+	// The same signature with another message is rejected
+	err = cc.Invoke(ctx, method, map[string]string{"id": "other"}, &details)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("replayed signature with another message: %v", err)
+	}
+
+	// Streams are authenticated by their first message
+	method = "/gilmour.proxy.v1.Proxy/RequestStream"
+	stream, err := cc.NewStream(sign(method, signed), &grpc.StreamDesc{ServerStreams: true}, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SendMsg(map[string]string{"id": created.ID, "topic": "other"})
+	stream.CloseSend()
+	if err = stream.RecvMsg(&details); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("stream with a signature of another message: %v", err)
+	}
+}
@@ -4,14 +4,32 @@ package main
 
 import (
 	"./proxy"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// redisAddr is the Redis server node engines connect to
+var redisAddr = "127.0.0.1:6379"
+
 func getNode(id string) (node *proxy.Node, err error) {
 	nm := proxy.GetNodeMap()
 	node, err = nm.Get(proxy.NodeID(id))
@@ -46,48 +64,122 @@ func logWriterError(w http.ResponseWriter, err error) {
 	return
 }
 
-func createNodeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		body, err := ioutil.ReadAll(r.Body)
-		log.Println(string(body))
-		if err != nil {
-			fmt.Fprintf(w, "Error : %s!", err)
-			return
+// logValidationError writes a 400 response listing every invalid field
+func logValidationError(w http.ResponseWriter, verr proxy.ValidationErrors) {
+	log.Println(verr.Error())
+	js, err := json.Marshal(validationErrorResponse{Error: verr.Error(), Fields: verr})
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err := w.Write(js); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err = w.Write(js); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// registerNode creates, starts and watches the node described in the request body.
+// On failure it writes the error response itself and returns nil.
+func registerNode(w http.ResponseWriter, r *http.Request) *proxy.Node {
+	body, err := ioutil.ReadAll(r.Body)
+	log.Println(string(body))
+	if err != nil {
+		fmt.Fprintf(w, "Error : %s!", err)
+		return nil
+	}
+	nodeReq := new(proxy.NodeReq)
+	if err = json.Unmarshal(body, nodeReq); err != nil {
+		fmt.Fprintf(w, "Error : %s ", err)
+		return nil
+	}
+	if err = nodeReq.Validate(); err != nil {
+		logValidationError(w, err.(proxy.ValidationErrors))
+		return nil
+	}
+	engine, err := proxy.MakeGilmour(redisAddr)
+	if err != nil {
+		fmt.Fprintf(w, "Error : %s!", err)
+		return nil
+	}
+	node, err := proxy.CreateNode(nodeReq, engine)
+	if err != nil {
+		fmt.Fprintf(w, "Error : %s!", err)
+		return nil
+	}
+	if err = startNode(node, credential(r)); err != nil {
+		if verr, ok := err.(proxy.ValidationErrors); ok {
+			logValidationError(w, verr)
+			return nil
 		}
-		nodeReq := new(proxy.NodeReq)
-		if err = json.Unmarshal(body, nodeReq); err != nil {
-			fmt.Fprintf(w, "Error : %s ", err)
-			return
+		if _, denied := err.(proxy.PolicyDenied); denied {
+			writeJSON(w, http.StatusForbidden, errorResponse{err.Error()})
+			return nil
 		}
-		engine, err := proxy.MakeGilmour("127.0.0.1:6379")
+		fmt.Fprintf(w, "Error : %s!", err)
+		return nil
+	}
+	return node
+}
+
+// startNode binds the node to its credential, starts it and watches it. A node which cannot start is removed.
+func startNode(node *proxy.Node, cred *proxy.Credential) error {
+	if err := node.BindCredential(cred); err != nil {
+		proxy.DeleteNode(node, true, 0)
+		return err
+	}
+	if err := node.Start(); err != nil {
+		proxy.DeleteNode(node, true, 0)
+		return err
+	}
+	go proxy.NodeWatchdog(node)
+	return nil
+}
+
+// registerChannelNode returns the register function for proxy.ServeChannel, which creates
+// channel nodes owned by cred
+func registerChannelNode(transport string, cred *proxy.Credential) func(*proxy.NodeReq) (*proxy.Node, error) {
+	return func(nodeReq *proxy.NodeReq) (*proxy.Node, error) {
+		engine, err := proxy.MakeGilmour(redisAddr)
 		if err != nil {
-			fmt.Fprintf(w, "Error : %s!", err)
-			return
+			return nil, err
 		}
-		node, err := proxy.CreateNode(nodeReq, engine)
+		node, err := proxy.CreateChannelNode(nodeReq, engine, transport)
 		if err != nil {
-			fmt.Fprintf(w, "Error : %s!", err)
-			return
+			return nil, err
 		}
-		if err = node.Start(); err != nil {
-			fmt.Fprintf(w, "Error : %s!", err)
-			return
+		if err = startNode(node, cred); err != nil {
+			return nil, err
 		}
+		return node, nil
+	}
+}
 
-		go proxy.NodeWatchdog(node)
+func createNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if node := registerNode(w, r); node != nil {
+		writeJSON(w, http.StatusOK, node.FormatResponse())
+	}
+}
 
-		response := node.FormatResponse()
-		js, err := json.Marshal(response)
-		if err != nil {
-			fmt.Fprintf(w, "Error : %s!", err)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		if _, err = w.Write(js); err != nil {
-			log.Println(err.Error())
-		}
+// POST /v1/nodes
+func createNodeHandlerV1(w http.ResponseWriter, r *http.Request) {
+	if node := registerNode(w, r); node != nil {
+		writeJSON(w, http.StatusOK, node.FormatResponseV1())
 	}
-	return
 }
 
 //Get node details
@@ -107,7 +199,151 @@ func getNodeDetails(w http.ResponseWriter, req *http.Request) {
 	w.Write(data)
 }
 
-// Delete Node
+// GET /v1/nodes/:id
+func getNodeDetailsV1(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logWriterError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, node.DetailsV1())
+}
+
+// writeRateLimited writes a 429 response telling the client when to retry
+func writeRateLimited(w http.ResponseWriter, err proxy.RateLimitError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, errorResponse{err.Error()})
+}
+
+// bodyLimitMiddleware answers 413 to requests with a body over the publish or control limit.
+// The body is read here, within the limit, so handlers and HMAC authentication never see more.
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limits := proxy.GetBodyLimits()
+		limit := limits.Control
+		if strings.HasPrefix(strings.TrimPrefix(req.URL.Path, "/v1"), "/request/") {
+			limit = limits.Publish
+		}
+		if limit > 0 && req.ContentLength > limit {
+			writeBodyTooLarge(w, limit)
+			return
+		}
+		body, err := proxy.ReadLimited(req.Body, limit)
+		req.Body.Close()
+		if err == proxy.ErrBodyTooLarge {
+			writeBodyTooLarge(w, limit)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			logWriterError(w, err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	log.Println("Rejected request body over", limit, "bytes")
+	w.Header().Set("Connection", "close")
+	writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{fmt.Sprintf("Request %s, over %d bytes", proxy.ErrBodyTooLarge, limit)})
+}
+
+// GET /request/:id/:reqid
+func getAsyncRequestHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	node, err := getNode(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logWriterError(w, err)
+		return
+	}
+	ar, err := node.GetAsyncRequest(vars["reqid"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logWriterError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ar)
+}
+
+// wsSubprotocol is selected for WebSocket clients which offer subprotocols, as browsers
+// do to send their credentials
+const wsSubprotocol = "gilmour"
+
+// wsOrigins are the origins of pages, besides the proxy's own, which may open /ws
+var wsOrigins []string
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{wsSubprotocol},
+	CheckOrigin:  wsOriginAllowed,
+}
+
+// wsOriginAllowed accepts clients which are not browsers, and pages from the proxy's
+// host or one of wsOrigins
+func wsOriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, allowed := range wsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /ws
+// Upgrades to the WebSocket channel, on which a node registers and is dispatched to
+// without exposing an HTTP port of its own
+func webSocketHandler(w http.ResponseWriter, req *http.Request) {
+	cred := credential(req)
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade has already answered the client
+		log.Println(err.Error())
+		return
+	}
+	proxy.ServeWebSocket(conn, cred, registerChannelNode(proxy.TransportWebSocket, cred))
+}
+
+// PUT /nodes/:id/rate_limits
+func setRateLimitsHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logWriterError(w, err)
+		return
+	}
+	// Owners may not raise their own limits
+	if cred := credential(req); cred != nil && !cred.Admin {
+		writeJSON(w, http.StatusForbidden, errorResponse{"Only admins can change rate limits"})
+		return
+	}
+	var limits proxy.NodeRateLimits
+	if err = json.NewDecoder(req.Body).Decode(&limits); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logWriterError(w, err)
+		return
+	}
+	if err = node.SetRateLimits(limits); err != nil {
+		logValidationError(w, err.(proxy.ValidationErrors))
+		return
+	}
+	writeJSON(w, http.StatusOK, node.RateLimits())
+}
+
+// DELETE /nodes/:id?force=<bool>&timeout=<duration>
 func deleteNodeHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
@@ -116,17 +352,59 @@ func deleteNodeHandler(w http.ResponseWriter, req *http.Request) {
 		logWriterError(w, err)
 		return
 	}
+	timeout := 30 * time.Second
+	if t := req.URL.Query().Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			logWriterError(w, err)
+			return
+		}
+	}
+	force := req.URL.Query().Get("force") == "true"
 
-	if err = proxy.DeleteNode(node); err != nil {
+	writeJSON(w, http.StatusOK, proxy.DeleteNode(node, force, timeout))
+}
+
+// POST /nodes/:id/drain?timeout=<duration>&delete=<bool>
+func drainNodeHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
+	if err != nil {
 		logWriterError(w, err)
 		return
 	}
+	timeout := 30 * time.Second
+	if t := req.URL.Query().Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			logWriterError(w, err)
+			return
+		}
+	}
+	deleteNode := req.URL.Query().Get("delete") == "true"
 
-	js := formatResponse("status", "ok")
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(js.([]byte)); err != nil {
+	inFlight, err := node.Drain(timeout)
+	deleted := false
+	if err == nil && deleteNode {
+		proxy.DeleteNode(node, true, 0)
+		deleted = true
+	}
+	writeJSON(w, http.StatusOK, drainResponse{Status: setResponseStatus(err), InFlight: inFlight, Deleted: deleted})
+}
+
+// writeSubscriptionResults writes the single response for a bulk add of services or slots
+func writeSubscriptionResults(w http.ResponseWriter, results []proxy.SubscriptionResult, err error) {
+	if verr, ok := err.(proxy.ValidationErrors); ok {
+		logValidationError(w, verr)
+		return
+	}
+	code := http.StatusOK
+	if _, denied := err.(proxy.PolicyDenied); denied {
+		code = http.StatusForbidden
+	} else if err != nil {
 		log.Println(err.Error())
+		code = http.StatusInternalServerError
 	}
+	writeJSON(w, code, subscriptionResponse{Status: setResponseStatus(err), Results: results})
 }
 
 // POST /nodes/:id/services
@@ -136,27 +414,21 @@ func addServicesHandler(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		fmt.Fprintf(w, "Error : %s!", err.Error())
+		return
 	}
-	service := new(proxy.ServiceMap)
-	err = json.Unmarshal(body, service)
-	if err != nil {
+	services := new(proxy.ServiceList)
+	if err = json.Unmarshal(body, services); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Error : %s!", err.Error())
+		return
 	}
 	node, err := getNode(id)
 	if err != nil {
 		logWriterError(w, err)
 		return
 	}
-	for topic, value := range *service {
-		err := node.AddService(topic, value)
-		status := setResponseStatus(err)
-		js := formatResponse("status", status)
-		w.Header().Set("Content-Type", "application/json")
-		if _, err = w.Write(js.([]byte)); err != nil {
-			log.Println(err.Error())
-		}
-	}
-	return
+	results, err := node.SubscribeServices(*services)
+	writeSubscriptionResults(w, results, err)
 }
 
 // GET /nodes/{id} getting details of an existing node
@@ -189,25 +461,21 @@ func addSlotsHandler(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		fmt.Fprintf(w, "Error : %s!", err.Error())
+		return
 	}
-	slot := new(proxy.Slot)
-	err = json.Unmarshal(body, slot)
-	if err != nil {
+	slots := new(proxy.SlotList)
+	if err = json.Unmarshal(body, slots); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Error : %s!", err.Error())
+		return
 	}
 	node, err := getNode(id)
 	if err != nil {
 		logWriterError(w, err)
 		return
 	}
-	err = node.AddSlot(*slot)
-	status := setResponseStatus(err)
-	js := formatResponse("status", status)
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(js.([]byte)); err != nil {
-		log.Println(err.Error())
-	}
-	return
+	results, err := node.SubscribeSlots(*slots)
+	writeSubscriptionResults(w, results, err)
 }
 
 // GET /nodes/:id/slots
@@ -276,6 +544,23 @@ func RequestServiceHandler(w http.ResponseWriter, req *http.Request) {
 		logWriterError(w, err)
 		return
 	}
+	if err = node.AllowPublish(serviceRequest.Topics()...); err != nil {
+		writeRateLimited(w, err.(proxy.RateLimitError))
+		return
+	}
+	if serviceRequest.Async {
+		ar, err := node.RequestServiceAsync(*serviceRequest)
+		if err != nil {
+			writeJSON(w, http.StatusTooManyRequests, errorResponse{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, ar)
+		return
+	}
+	if format := streamFormat(req); format != "" {
+		streamResponse(w, node, *serviceRequest, format)
+		return
+	}
 
 	response := node.RequestService(*serviceRequest)
 	data, err := json.Marshal(response)
@@ -296,42 +581,273 @@ func removeServicesHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	topic := proxy.GilmourTopic(req.URL.Query().Get("topic"))
-	services, err := node.GetServices()
+	path := req.URL.Query().Get("path")
+	removed, err := node.RemoveServices(topic, path)
+	code := http.StatusOK
+	if err == proxy.ErrServiceNotFound {
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, removeResponse{Status: setResponseStatus(err), Removed: len(removed)})
+}
+
+// GET /nodes/:id/deadletters
+func getDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	letters, err := node.GetDeadLetters()
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	js := formatResponse("dead_letters", letters)
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(js.([]byte)); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// POST /nodes/:id/deadletters/replay?id=<dead letter id>
+func replayDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
 	if err != nil {
 		logWriterError(w, err)
 		return
 	}
-	service := services[topic]
-	err = node.RemoveService(topic, service)
+	replayed, failed, err := node.ReplayDeadLetters(req.URL.Query()["id"])
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, replayResponse{Replayed: replayed, Failed: failed})
+}
+
+// DELETE /nodes/:id/deadletters?id=<dead letter id>
+func purgeDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	node, err := getNode(id)
+	if err != nil {
+		logWriterError(w, err)
+		return
+	}
+	err = node.PurgeDeadLetters(req.URL.Query()["id"])
 	status := setResponseStatus(err)
 	js := formatResponse("status", status)
 	w.Header().Set("Content-Type", "application/json")
 	if _, err = w.Write(js.([]byte)); err != nil {
 		log.Println(err.Error())
 	}
-	return
 }
 
 func main() {
+	flag.StringVar(&redisAddr, "redis", redisAddr, "address of the Redis server used by Gilmour")
+	legacyRoutes := flag.Bool("legacy-routes", true, "also serve the API on the original unversioned routes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests and node dispatches to finish on SIGTERM")
+	deadLetterStore := flag.String("dead-letters", "", `where to keep undeliverable slot signals: "redis", a directory path, or empty to drop them`)
+	wsAllowedOrigins := flag.String("ws-allowed-origins", "", "comma separated origins, e.g. https://app.example.com, of pages which may connect to /ws; * for any")
+	allowedHosts := flag.String("allowed-hosts", "", "comma separated host patterns remote nodes may be registered on")
+	nodeTLSDir := flag.String("node-tls-dir", "", "directory certificate files in a node's tls settings must be in; empty to only allow PEM")
+	socketDir := flag.String("socket-dir", "", "directory the unix sockets of nodes must be in; empty to not allow sockets")
+	clientConfig := proxy.GetClientConfig()
+	flag.IntVar(&clientConfig.MaxIdleConnsPerNode, "max-idle-conns-per-node", clientConfig.MaxIdleConnsPerNode, "keep-alive connections pooled per node")
+	flag.DurationVar(&clientConfig.IdleConnTimeout, "idle-conn-timeout", clientConfig.IdleConnTimeout, "how long pooled node connections stay open")
+	flag.DurationVar(&clientConfig.DialTimeout, "dial-timeout", clientConfig.DialTimeout, "timeout for connecting to a node")
+	flag.DurationVar(&clientConfig.TLSHandshakeTimeout, "tls-handshake-timeout", clientConfig.TLSHandshakeTimeout, "timeout for TLS handshakes with a node")
+	flag.DurationVar(&clientConfig.ResponseHeaderTimeout, "response-header-timeout", clientConfig.ResponseHeaderTimeout, "timeout for a node handler to start responding, 0 for none")
+	flag.DurationVar(&clientConfig.HealthCheckTimeout, "health-check-timeout", clientConfig.HealthCheckTimeout, "timeout for each health check request to a node")
+	flag.DurationVar(&clientConfig.DispatchTimeout, "dispatch-timeout", clientConfig.DispatchTimeout, "timeout for dispatches to a service or slot without a timeout")
+	breakerConfig := proxy.GetBreakerConfig()
+	flag.IntVar(&breakerConfig.FailureThreshold, "breaker-threshold", breakerConfig.FailureThreshold, "consecutive handler failures which open its circuit, 0 to disable")
+	flag.DurationVar(&breakerConfig.OpenTimeout, "breaker-open-timeout", breakerConfig.OpenTimeout, "how long an open circuit fails fast before a probe call")
+	apiKeys := flag.String("api-keys", "", `file of "<principal> <key> [admin]" lines accepted in the X-Api-Key header`)
+	hmacKeys := flag.String("hmac-keys", "", `file of "<key id> <secret> [admin]" lines for HMAC-SHA256 signed requests`)
+	jwtSecret := flag.String("jwt-secret", "", "shared secret for HS256 JWT bearer tokens")
+	jwtPublicKey := flag.String("jwt-public-key", "", "PEM file with the RSA or ECDSA key for RS/ES JWT bearer tokens")
+	policyFile := flag.String("policy", "", "JSON file of topic allow and deny rules")
+	topicRateLimits := flag.String("topic-rate-limits", "", "JSON file of per topic publish rate limits")
+	bodyLimits := proxy.GetBodyLimits()
+	flag.Int64Var(&bodyLimits.Control, "max-control-body", bodyLimits.Control, "largest control API request body in bytes, 0 for no limit")
+	flag.Int64Var(&bodyLimits.Publish, "max-publish-body", bodyLimits.Publish, "largest publish request body in bytes, 0 for no limit")
+	flag.Int64Var(&bodyLimits.Response, "max-response-body", bodyLimits.Response, "largest node handler response body in bytes, 0 for no limit")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve HTTPS with, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "key file of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle client certificates must be signed by; requires clients to present one")
+	grpcAddr := flag.String("grpc", "", "address to serve the gRPC API on, such as :9090; empty to disable it")
+	flag.Parse()
+
+	proxy.SetAllowedHosts(strings.Split(*allowedHosts, ","))
+	if *wsAllowedOrigins != "" {
+		wsOrigins = strings.Split(*wsAllowedOrigins, ",")
+	}
+	if err := proxy.SetSocketDir(*socketDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := proxy.SetNodeTLSDir(*nodeTLSDir); err != nil {
+		log.Fatal(err)
+	}
+	proxy.SetClientConfig(clientConfig)
+	proxy.SetBreakerConfig(breakerConfig)
+	proxy.SetBodyLimits(bodyLimits)
+	switch *deadLetterStore {
+	case "":
+	case "redis":
+		proxy.SetDeadLetterStore(proxy.NewRedisDeadLetters(redisAddr))
+	default:
+		store, err := proxy.NewFileDeadLetters(*deadLetterStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.SetDeadLetterStore(store)
+	}
+	var authenticators []proxy.Authenticator
+	if *apiKeys != "" {
+		a, err := proxy.NewAPIKeyAuth(*apiKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *hmacKeys != "" {
+		a, err := proxy.NewHMACAuth(*hmacKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *jwtSecret != "" || *jwtPublicKey != "" {
+		a, err := proxy.NewJWTAuth(*jwtSecret, *jwtPublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	proxy.SetAuthenticators(authenticators...)
+	if *policyFile != "" {
+		p, err := proxy.LoadPolicy(*policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = proxy.SetPolicy(p); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *topicRateLimits != "" {
+		limits, err := proxy.LoadTopicRateLimits(*topicRateLimits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = proxy.SetTopicRateLimits(limits); err != nil {
+			log.Fatal(err)
+		}
+	}
 	proxy.InitNodeMap()
 
 	r := mux.NewRouter()
+	r.Use(bodyLimitMiddleware, authMiddleware)
 	log.Println("listening...")
-	r.HandleFunc("/nodes", createNodeHandler).Methods("POST")
-	r.HandleFunc("/nodes/{id}", getNodeDetails).Methods("GET")
-	r.HandleFunc("/nodes/{id}", deleteNodeHandler).Methods("DELETE")
+	v1 := r.PathPrefix("/v1").Subrouter()
+	for _, rt := range routes {
+		v1.HandleFunc(rt.Path, rt.Handler).Methods(rt.Method)
+		if *legacyRoutes {
+			handler := rt.Handler
+			if rt.Legacy != nil {
+				handler = rt.Legacy
+			}
+			r.HandleFunc(rt.Path, handler).Methods(rt.Method)
+		}
+	}
+	r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
 
-	r.HandleFunc("/request/{id}", RequestServiceHandler).Methods("POST")
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-cert and -tls-key must be given together")
+		}
+		config, err := proxy.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = config
+	} else if *tlsClientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		var grpcTLS *tls.Config
+		if srv.TLSConfig != nil {
+			// A config of its own, so that clones made per client also offer HTTP/2
+			config, err := proxy.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.NextProtos = []string{"h2"}
+			grpcTLS = config
+		}
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcServer = newGRPCServer(grpcTLS)
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal(err.Error())
+			}
+		}()
+	}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err.Error())
+		}
+	}()
 
-	r.HandleFunc("/nodes/{id}/services", getServicesHandler).Methods("GET")
-	r.HandleFunc("/nodes/{id}/services", addServicesHandler).Methods("POST")
-	r.HandleFunc("/nodes/{id}/services", removeServicesHandler).Methods("DELETE")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	shutdownOnSignal(stop, srv, grpcServer, *shutdownTimeout)
+	log.Println("Stopped")
+}
 
-	r.HandleFunc("/nodes/{id}/slots", addSlotsHandler).Methods("POST")
-	r.HandleFunc("/nodes/{id}/slots", getSlotsHandler).Methods("GET")
-	r.HandleFunc("/nodes/{id}/slots", removeSlotsHandler).Methods("DELETE")
+// shutdownOnSignal waits for a signal on stop, then stops accepting control requests,
+// waits for those in progress, and drains and stops every node, all within timeout.
+// grpcServer may be nil.
+func shutdownOnSignal(stop <-chan os.Signal, srv *http.Server, grpcServer *grpc.Server, timeout time.Duration) {
+	sig := <-stop
+	log.Println("Received", sig, "shutting down...")
 
-	if err := http.ListenAndServe(":8080", r); err != nil {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
 		log.Println(err.Error())
 	}
+	// Connect streams stay open until proxy.Shutdown stops their nodes
+	grpcStopped := make(chan struct{})
+	if grpcServer != nil {
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+	if err := proxy.Shutdown(time.Until(deadline)); err != nil {
+		log.Println(err.Error())
+	}
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"./proxy"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIGenerator builds an OpenAPI 3 document from the route table, deriving
+// request and response schemas from the Go types the handlers use
+type openAPIGenerator struct {
+	schemas map[string]interface{}
+}
+
+func (g *openAPIGenerator) document(routes []route) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range routes {
+		path := "/v1" + rt.Path
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(rt.Method)] = g.operation(rt)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Gilmour proxy",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": g.schemas},
+	}
+}
+
+func (g *openAPIGenerator) operation(rt route) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathParam.FindAllStringSubmatch(rt.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+		})
+	}
+	for _, q := range rt.Query {
+		params = append(params, map[string]interface{}{
+			"name": q, "in": "query", "schema": map[string]string{"type": "string"},
+		})
+	}
+	op := map[string]interface{}{
+		"summary": rt.Summary,
+		"responses": map[string]interface{}{
+			"200":     jsonContent("OK", g.schema(reflect.TypeOf(rt.Response))),
+			"400":     jsonContent("Invalid request", g.schema(reflect.TypeOf(validationErrorResponse{}))),
+			"default": jsonContent("Error", g.schema(reflect.TypeOf(errorResponse{}))),
+		},
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if rt.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(rt.Request))},
+			},
+		}
+	}
+	return op
+}
+
+func jsonContent(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// schema returns the schema for t, adding named proxy and API structs to the components
+func (g *openAPIGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(proxy.PortValue("")):
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]string{"type": "integer"}, map[string]string{"type": "string"},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if !documented(t) {
+			return map[string]interface{}{"type": "object"}
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // placeholder, so recursive types terminate
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// documented reports whether a struct is one of ours, rather than e.g. a Gilmour type
+func documented(t reflect.Type) bool {
+	return t.Name() != "" && (t.PkgPath() == reflect.TypeOf(route{}).PkgPath() || strings.HasSuffix(t.PkgPath(), "proxy"))
+}
+
+func (g *openAPIGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	g.properties(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// properties adds t's JSON fields. Fields of embedded structs are added unless an outer field
+// has the same name, matching encoding/json
+func (g *openAPIGenerator) properties(t reflect.Type, properties map[string]interface{}) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "" {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		properties[tag] = g.schema(f.Type)
+	}
+	for _, e := range embedded {
+		inner := make(map[string]interface{})
+		g.properties(e, inner)
+		for name, schema := range inner {
+			if _, ok := properties[name]; !ok {
+				properties[name] = schema
+			}
+		}
+	}
+}
+
+var openAPIDoc struct {
+	sync.Once
+	doc map[string]interface{}
+}
+
+// GET /openapi.json
+func openAPIHandler(w http.ResponseWriter, req *http.Request) {
+	openAPIDoc.Do(func() {
+		g := &openAPIGenerator{schemas: make(map[string]interface{})}
+		openAPIDoc.doc = g.document(routes)
+	})
+	writeJSON(w, http.StatusOK, openAPIDoc.doc)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPIValidationErrorSchema(t *testing.T) {
+	g := &openAPIGenerator{schemas: make(map[string]interface{})}
+	doc := g.document(routes)
+	op := doc["paths"].(map[string]map[string]interface{})["/v1/nodes"]["post"].(map[string]interface{})
+	badRequest := op["responses"].(map[string]interface{})["400"].(map[string]interface{})
+	schema := badRequest["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+	if ref := schema.(map[string]interface{})["$ref"]; ref != "#/components/schemas/validationErrorResponse" {
+		t.Fatalf("400 schema = %v", schema)
+	}
+	properties := g.schemas["validationErrorResponse"].(map[string]interface{})["properties"].(map[string]interface{})
+
+	// The schema has the fields logValidationError writes
+	w := httptest.NewRecorder()
+	logValidationError(w, nil)
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for field := range body {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("response field %q is not in the schema", field)
+		}
+	}
+	if len(properties) != len(body) {
+		t.Errorf("schema properties %v, response %v", properties, body)
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// PortValue is a node port. The README documents it as a number, older clients send a string,
+// so both are accepted.
+type PortValue string
+
+func (p *PortValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*p = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*p = PortValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*p = PortValue(n.String())
+	return nil
+}
+
+// CreateNodeResponseV1 is the /v1 response to node registration, as documented in the README
+type CreateNodeResponseV1 struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Secret string `json:"secret"`
+}
+
+// NodeDetailsV1 is the /v1 node details. It reports the port as a number
+type NodeDetailsV1 struct {
+	NodeDetailsReq
+	Port int `json:"port,omitempty"`
+}
+
+// FormatResponseV1 returns the /v1 registration response
+func (node *Node) FormatResponseV1() CreateNodeResponseV1 {
+	return CreateNodeResponseV1{ID: string(node.id), Status: node.StatusString(), Secret: node.secret}
+}
+
+// DetailsV1 returns the /v1 node details
+func (node *Node) DetailsV1() NodeDetailsV1 {
+	details := NodeDetailsV1{NodeDetailsReq: node.Details()}
+	details.Port, _ = strconv.Atoi(node.port)
+	return details
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Statuses of an asynchronous request
+const (
+	AsyncPending = "pending"
+	AsyncDone    = "done"
+)
+
+// AsyncResultTTL is how long a finished asynchronous request can still be polled
+const AsyncResultTTL = 10 * time.Minute
+
+// MaxAsyncPending is how many asynchronous requests of a node may wait for their response at once
+const MaxAsyncPending = 1000
+
+var (
+	// ErrRequestNotFound is returned when polling an unknown or expired asynchronous request
+	ErrRequestNotFound = errors.New("Request not found")
+	// ErrTooManyAsync is returned for an asynchronous request over MaxAsyncPending
+	ErrTooManyAsync = errors.New("Too many asynchronous requests pending")
+)
+
+// callbackRetry is the retry policy for delivering asynchronous responses to the node
+var callbackRetry = &RetryPolicy{MaxAttempts: 3}
+
+// AsyncRequest tracks a request made with "async": true
+type AsyncRequest struct {
+	ID            string           `json:"request_id"`
+	Topic         string           `json:"topic"`
+	Status        string           `json:"status"`
+	Callback      string           `json:"callback,omitempty"`
+	Delivered     bool             `json:"delivered"`
+	DeliveryError string           `json:"delivery_error,omitempty"`
+	Response      *RequestResponse `json:"response,omitempty"`
+	Created       time.Time        `json:"created"`
+	Completed     *time.Time       `json:"completed,omitempty"`
+}
+
+// AsyncCallback is the data posted to the node's callback path when the response arrives
+type AsyncCallback struct {
+	ID       string          `json:"request_id"`
+	Topic    string          `json:"topic"`
+	Response RequestResponse `json:"response"`
+}
+
+// asyncRequests holds a node's asynchronous requests until they expire
+type asyncRequests struct {
+	sync.Mutex
+	requests map[string]*AsyncRequest
+	pending  int
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestServiceAsync sends the request in the background and returns straight away.
+// The response is posted to serviceRequest.Callback on the node, if set, and can be
+// polled with GetAsyncRequest. ErrTooManyAsync is returned when the node already has
+// MaxAsyncPending requests waiting.
+func (node *Node) RequestServiceAsync(serviceRequest Request) (AsyncRequest, error) {
+	ar := &AsyncRequest{
+		ID:       newRequestID(),
+		Topic:    serviceRequest.Topic,
+		Status:   AsyncPending,
+		Callback: serviceRequest.Callback,
+		Created:  time.Now(),
+	}
+	node.async.Lock()
+	if node.async.pending >= MaxAsyncPending {
+		node.async.Unlock()
+		return AsyncRequest{}, ErrTooManyAsync
+	}
+	node.async.pending++
+	node.expireAsync()
+	if node.async.requests == nil {
+		node.async.requests = make(map[string]*AsyncRequest)
+	}
+	node.async.requests[ar.ID] = ar
+	snapshot := *ar
+	node.async.Unlock()
+
+	node.begin()
+	go func() {
+		defer node.end()
+		response := node.RequestService(serviceRequest)
+		node.async.Lock()
+		node.async.pending--
+		ar.Status = AsyncDone
+		ar.Response = &response
+		now := time.Now()
+		ar.Completed = &now
+		node.async.Unlock()
+		if ar.Callback != "" {
+			node.deliverAsync(ar, response)
+		}
+	}()
+	return snapshot, nil
+}
+
+// deliverAsync posts the response to the node's callback path
+func (node *Node) deliverAsync(ar *AsyncRequest, response RequestResponse) {
+	message := &Message{
+		Data:        AsyncCallback{ID: ar.ID, Topic: ar.Topic, Response: response},
+		HandlerPath: ar.Callback,
+	}
+	_, _, attempts, err := node.dispatchWithRetry(ar.Callback, message, callbackRetry, 0)
+	node.async.Lock()
+	defer node.async.Unlock()
+	if err != nil {
+		log.Println("Cannot deliver response", ar.ID, "to", ar.Callback, "after", attempts, "attempts:", err)
+		ar.DeliveryError = err.Error()
+		return
+	}
+	ar.Delivered = true
+}
+
+// GetAsyncRequest returns the state of an asynchronous request, with its response once done
+func (node *Node) GetAsyncRequest(id string) (AsyncRequest, error) {
+	node.async.Lock()
+	defer node.async.Unlock()
+	node.expireAsync()
+	ar, ok := node.async.requests[id]
+	if !ok {
+		return AsyncRequest{}, ErrRequestNotFound
+	}
+	return *ar, nil
+}
+
+// expireAsync forgets requests which finished more than AsyncResultTTL ago.
+// The caller must hold node.async.
+func (node *Node) expireAsync() {
+	for id, ar := range node.async.requests {
+		if ar.Completed != nil && time.Since(*ar.Completed) > AsyncResultTTL {
+			delete(node.async.requests, id)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveCallbacks runs a node on a socket whose /callback handler passes on what it receives
+func serveCallbacks(t *testing.T) (*Node, chan AsyncCallback, func()) {
+	dir, _, stop := serveSocket(t)
+	socket := filepath.Join(dir, "callbacks.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callbacks := make(chan AsyncCallback, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health_check", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		var m struct{ Data AsyncCallback }
+		json.NewDecoder(r.Body).Decode(&m)
+		callbacks <- m.Data
+		w.Write([]byte("{}"))
+	})
+	go http.Serve(l, mux)
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node, callbacks, func() {
+		l.Close()
+		stop()
+	}
+}
+
+// waitAsync polls the request until it is done
+func waitAsync(t *testing.T, node *Node, id string) AsyncRequest {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		ar, err := node.GetAsyncRequest(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ar.Status == AsyncDone {
+			return ar
+		}
+	}
+	t.Fatal("request still pending")
+	return AsyncRequest{}
+}
+
+func TestAsyncRequestPolling(t *testing.T) {
+	InitNodeMap()
+	node, _, stop := serveCallbacks(t)
+	defer stop()
+
+	ar, err := node.RequestServiceAsync(Request{Topic: "reports"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Status != AsyncPending || ar.ID == "" || ar.Topic != "reports" {
+		t.Fatalf("accepted request = %+v", ar)
+	}
+	done := waitAsync(t, node, ar.ID)
+	if done.Response == nil || done.Completed == nil || done.Delivered {
+		t.Fatalf("finished request = %+v", done)
+	}
+	if _, err = node.GetAsyncRequest("unknown"); err != ErrRequestNotFound {
+		t.Fatalf("unknown request: %v", err)
+	}
+}
+
+func TestAsyncRequestCallback(t *testing.T) {
+	InitNodeMap()
+	node, callbacks, stop := serveCallbacks(t)
+	defer stop()
+
+	ar, err := node.RequestServiceAsync(Request{Topic: "reports", Callback: "/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cb := <-callbacks:
+		if cb.ID != ar.ID || cb.Topic != "reports" {
+			t.Fatalf("callback = %+v", cb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if done, _ := node.GetAsyncRequest(ar.ID); done.Delivered {
+			return
+		}
+	}
+	t.Fatal("callback not reported as delivered")
+}
+
+func TestAsyncRequestsExpire(t *testing.T) {
+	InitNodeMap()
+	node, _, stop := serveCallbacks(t)
+	defer stop()
+
+	ar, err := node.RequestServiceAsync(Request{Topic: "reports"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAsync(t, node, ar.ID)
+	node.async.Lock()
+	completed := time.Now().Add(-AsyncResultTTL - time.Second)
+	node.async.requests[ar.ID].Completed = &completed
+	node.async.Unlock()
+	if _, err = node.GetAsyncRequest(ar.ID); err != ErrRequestNotFound {
+		t.Fatalf("expired request: %v", err)
+	}
+}
+
+func TestAsyncRequestsAreCapped(t *testing.T) {
+	node := &Node{metrics: new(NodeMetrics)}
+	node.async.pending = MaxAsyncPending
+	if _, err := node.RequestServiceAsync(Request{Topic: "reports"}); err != ErrTooManyAsync {
+		t.Fatalf("request over the cap: %v", err)
+	}
+	if len(node.async.requests) != 0 {
+		t.Fatalf("requests = %v", node.async.requests)
+	}
+
+	node.async.pending = MaxAsyncPending - 1
+	ar, err := node.RequestServiceAsync(Request{Topic: "reports"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAsync(t, node, ar.ID)
+	node.async.Lock()
+	pending := node.async.pending
+	node.async.Unlock()
+	if pending != MaxAsyncPending-1 {
+		t.Fatalf("pending after the response = %d", pending)
+	}
+}
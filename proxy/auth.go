@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+// Headers read by the authenticators
+const (
+	APIKeyHeader          = "X-Api-Key"
+	SignatureTimestampHdr = "X-Signature-Timestamp"
+	hmacScheme            = "HMAC-SHA256 "
+	bearerScheme          = "Bearer "
+)
+
+// HMACWindow is how far a signed request's timestamp may be from the proxy's clock
+const HMACWindow = 5 * time.Minute
+
+var (
+	// ErrUnauthenticated is returned when a request carries no credential the proxy accepts
+	ErrUnauthenticated = errors.New("Authentication required")
+	// ErrForbidden is returned when a credential may not use a node
+	ErrForbidden = errors.New("Node belongs to another credential")
+)
+
+// Credential identifies the caller of the control or publish API. Nodes it registers
+// get its Labels, which topic policy rules can select.
+type Credential struct {
+	Principal string
+	Admin     bool
+	Labels    map[string]string
+}
+
+// Authenticator checks one kind of credential. It returns nil, nil when the request does not
+// carry that kind, so the next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Credential, error)
+}
+
+var authenticators struct {
+	sync.RWMutex
+	list []Authenticator
+}
+
+// SetAuthenticators replaces the accepted credential kinds. With none, authentication is off.
+func SetAuthenticators(list ...Authenticator) {
+	authenticators.Lock()
+	defer authenticators.Unlock()
+	authenticators.list = list
+}
+
+// AuthEnabled reports whether any authenticator is configured
+func AuthEnabled() bool {
+	authenticators.RLock()
+	defer authenticators.RUnlock()
+	return len(authenticators.list) > 0
+}
+
+// Authenticate returns the request's credential. It returns nil, nil when authentication is off.
+func Authenticate(r *http.Request) (*Credential, error) {
+	authenticators.RLock()
+	list := authenticators.list
+	authenticators.RUnlock()
+	if len(list) == 0 {
+		return nil, nil
+	}
+	for _, a := range list {
+		cred, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if cred != nil {
+			return cred, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// keyEntry is one line of a key file: a name, its secret, and whether it is an admin
+type keyEntry struct {
+	name   string
+	secret string
+	admin  bool
+	labels map[string]string
+}
+
+// readKeyFile parses lines of "<name> <secret> [admin] [<label>=<value> ...]".
+// Blank lines and # comments are skipped.
+func readKeyFile(path string) (entries []keyEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected <name> <secret> [admin] [<label>=<value> ...]", path, n)
+		}
+		entry := keyEntry{name: fields[0], secret: fields[1]}
+		for i, field := range fields[2:] {
+			if i == 0 && field == "admin" {
+				entry.admin = true
+				continue
+			}
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("%s:%d: expected <label>=<value>, not %q", path, n, field)
+			}
+			if entry.labels == nil {
+				entry.labels = make(map[string]string)
+			}
+			entry.labels[kv[0]] = kv[1]
+		}
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	return
+}
+
+// APIKeyAuth accepts static keys sent in the X-Api-Key header
+type APIKeyAuth struct {
+	keys []keyEntry
+}
+
+// NewAPIKeyAuth loads keys from a file of "<principal> <key> [admin]" lines
+func NewAPIKeyAuth(path string) (*APIKeyAuth, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyAuth{keys: keys}, nil
+}
+
+func (a *APIKeyAuth) Authenticate(r *http.Request) (*Credential, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k.secret), []byte(key)) == 1 {
+			return &Credential{Principal: k.name, Admin: k.admin, Labels: k.labels}, nil
+		}
+	}
+	return nil, errors.New("Invalid API key")
+}
+
+// HMACAuth accepts requests signed with a shared secret. The Authorization header is
+// "HMAC-SHA256 <key id>:<base64 signature>" and X-Signature-Timestamp holds the unix time.
+// The signature is over the method, the path with its query, the timestamp and the
+// hex SHA-256 of the body, joined by newlines.
+type HMACAuth struct {
+	keys map[string]keyEntry
+}
+
+// NewHMACAuth loads secrets from a file of "<key id> <secret> [admin]" lines.
+// The key id is the credential's principal.
+func NewHMACAuth(path string) (*HMACAuth, error) {
+	entries, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &HMACAuth{keys: make(map[string]keyEntry)}
+	for _, e := range entries {
+		a.keys[e.name] = e
+	}
+	return a, nil
+}
+
+func (a *HMACAuth) Authenticate(r *http.Request) (*Credential, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, hmacScheme) {
+		return nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, hmacScheme), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed HMAC authorization")
+	}
+	key, ok := a.keys[parts[0]]
+	if !ok {
+		return nil, errors.New("Unknown HMAC key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Malformed HMAC signature")
+	}
+	timestamp := r.Header.Get(SignatureTimestampHdr)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("Missing or malformed " + SignatureTimestampHdr)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > HMACWindow || skew < -HMACWindow {
+		return nil, errors.New("Signature timestamp outside the allowed window")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, SignRequest(key.secret, r.Method, r.URL.RequestURI(), timestamp, body)) {
+		return nil, errors.New("Invalid HMAC signature")
+	}
+	return &Credential{Principal: key.name, Admin: key.admin, Labels: key.labels}, nil
+}
+
+// SignRequest returns the HMAC-SHA256 signature HMACAuth expects for a request
+func SignRequest(secret, method, uri, timestamp string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:])))
+	return mac.Sum(nil)
+}
+
+// JWTAuth accepts bearer tokens signed with an HMAC secret (HS256/384/512) or an RSA or
+// ECDSA public key. The "sub" claim is the principal, an "admin" claim of true makes
+// the credential an admin, and a "labels" claim holds the credential's labels.
+type JWTAuth struct {
+	secret    []byte
+	publicKey interface{}
+}
+
+// NewJWTAuth accepts tokens signed with secret, or with the key in the PEM file publicKeyPath.
+// Either may be empty.
+func NewJWTAuth(secret string, publicKeyPath string) (*JWTAuth, error) {
+	a := &JWTAuth{secret: []byte(secret)}
+	if publicKeyPath == "" {
+		return a, nil
+	}
+	pem, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if a.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+		if a.publicKey, err = jwt.ParseECPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("%s: not an RSA or ECDSA public key", publicKeyPath)
+		}
+	}
+	return a, nil
+}
+
+type jwtClaims struct {
+	jwt.StandardClaims
+	Admin  bool              `json:"admin"`
+	Labels map[string]string `json:"labels"`
+}
+
+func (a *JWTAuth) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(a.secret) > 0 {
+			return a.secret, nil
+		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		if a.publicKey != nil {
+			return a.publicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+}
+
+func (a *JWTAuth) Authenticate(r *http.Request) (*Credential, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerScheme) {
+		return nil, nil
+	}
+	claims := new(jwtClaims)
+	if _, err := jwt.ParseWithClaims(strings.TrimPrefix(header, bearerScheme), claims, a.key); err != nil {
+		return nil, fmt.Errorf("Invalid token: %s", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("Invalid token: no subject")
+	}
+	return &Credential{Principal: claims.Subject, Admin: claims.Admin, Labels: claims.Labels}, nil
+}
+
+// BindCredential makes the principal of cred, which registered the node, its owner, and gives
+// the node the credential's labels. Only admins may add labels of their own in the
+// registration request, so that a node cannot choose which policy rules select it.
+// A nil credential means authentication is off.
+func (node *Node) BindCredential(cred *Credential) error {
+	requested := node.labels
+	if len(requested) > 0 && (cred == nil || !cred.Admin) {
+		return ValidationErrors{{Field: "labels", Message: "can only be set by an admin; nodes get the labels of their credential"}}
+	}
+	node.labels = nil
+	if cred == nil {
+		return nil
+	}
+	node.owner = cred.Principal
+	for _, labels := range []map[string]string{cred.Labels, requested} {
+		for k, v := range labels {
+			if node.labels == nil {
+				node.labels = make(map[string]string)
+			}
+			node.labels[k] = v
+		}
+	}
+	return nil
+}
+
+// Owner returns the principal which registered the node
+func (node *Node) Owner() string {
+	return node.owner
+}
+
+// Authorize returns ErrForbidden unless cred may manage the node and publish as it.
+// A nil credential means authentication is off.
+func (node *Node) Authorize(cred *Credential) error {
+	if cred == nil || cred.Admin || (node.owner != "" && node.owner == cred.Principal) {
+		return nil
+	}
+	return ErrForbidden
+}
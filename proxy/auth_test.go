@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+func TestReadKeyFileLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+	data := "# comment\nweb k1 team=web env=prod\nops k2 admin\n"
+	if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	if e := entries[0]; e.admin || e.labels["team"] != "web" || e.labels["env"] != "prod" {
+		t.Errorf("web entry = %+v", e)
+	}
+	if e := entries[1]; !e.admin || e.labels != nil {
+		t.Errorf("ops entry = %+v", e)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("web k1 notalabel\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readKeyFile(path); err == nil {
+		t.Error("malformed label accepted")
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	auth, err := NewJWTAuth("s3cret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims jwt.Claims, secret string) *http.Request {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/nodes", nil)
+		r.Header.Set("Authorization", bearerScheme+token)
+		return r
+	}
+
+	claims := jwtClaims{StandardClaims: jwt.StandardClaims{Subject: "web"}, Labels: map[string]string{"team": "web"}}
+	cred, err := auth.Authenticate(sign(claims, "s3cret"))
+	if err != nil || cred.Principal != "web" || cred.Admin || cred.Labels["team"] != "web" {
+		t.Fatalf("valid token: %+v, %v", cred, err)
+	}
+	if _, err = auth.Authenticate(sign(claims, "other")); err == nil {
+		t.Error("token with the wrong secret accepted")
+	}
+	claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	if _, err = auth.Authenticate(sign(claims, "s3cret")); err == nil {
+		t.Error("expired token accepted")
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrBodyTooLarge is returned when a request or handler response body is over its limit
+var ErrBodyTooLarge = errors.New("body too large")
+
+// BodyLimits are the largest bodies, in bytes, the proxy reads. 0 means no limit.
+type BodyLimits struct {
+	Control  int64 `json:"control"`  // requests to the control API
+	Publish  int64 `json:"publish"`  // publish requests from nodes
+	Response int64 `json:"response"` // responses from node handlers
+}
+
+var bodyLimits = struct {
+	sync.RWMutex
+	BodyLimits
+}{
+	BodyLimits: BodyLimits{Control: 1 << 20, Publish: 8 << 20, Response: 8 << 20},
+}
+
+// SetBodyLimits replaces the body limits. Nodes keep the response limit they registered with.
+func SetBodyLimits(l BodyLimits) {
+	bodyLimits.Lock()
+	defer bodyLimits.Unlock()
+	bodyLimits.BodyLimits = l
+}
+
+// GetBodyLimits returns the current body limits
+func GetBodyLimits() BodyLimits {
+	bodyLimits.RLock()
+	defer bodyLimits.RUnlock()
+	return bodyLimits.BodyLimits
+}
+
+// ReadLimited reads all of r, returning ErrBodyTooLarge without reading further once
+// it has more than limit bytes
+func ReadLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
+
+// readResponse reads a handler response body within the node's response limit
+func (node *Node) readResponse(r io.Reader) ([]byte, error) {
+	body, err := ReadLimited(r, node.bodyLimits.Response)
+	if err == ErrBodyTooLarge {
+		err = fmt.Errorf("response %s, over %d bytes", ErrBodyTooLarge, node.bodyLimits.Response)
+	}
+	return body, err
+}
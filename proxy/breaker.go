@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitOpenCode is the response code sent to a requester while a handler's circuit is open
+const CircuitOpenCode = 503
+
+// ErrCircuitOpen is returned for dispatches short-circuited by an open breaker
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// BreakerConfig controls when a handler's circuit opens and how long it stays open
+type BreakerConfig struct {
+	FailureThreshold int           // consecutive failures which open the circuit, 0 disables breakers
+	OpenTimeout      time.Duration // time before a single probe call is let through
+}
+
+var breakerConfig = struct {
+	sync.RWMutex
+	BreakerConfig
+}{
+	BreakerConfig: BreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second},
+}
+
+// SetBreakerConfig replaces the breaker settings used for handlers from now on
+func SetBreakerConfig(c BreakerConfig) {
+	breakerConfig.Lock()
+	defer breakerConfig.Unlock()
+	breakerConfig.BreakerConfig = c
+}
+
+// GetBreakerConfig returns the current breaker settings
+func GetBreakerConfig() BreakerConfig {
+	breakerConfig.RLock()
+	defer breakerConfig.RUnlock()
+	return breakerConfig.BreakerConfig
+}
+
+// breaker is the circuit breaker for one handler path on a node
+type breaker struct {
+	sync.Mutex
+	config   BreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker() *breaker {
+	return &breaker{config: GetBreakerConfig(), state: CircuitClosed}
+}
+
+// allow reports whether a call may be made. Once the open timeout has passed,
+// one probe call is let through in the half-open state.
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.config.FailureThreshold <= 0 {
+		return true
+	}
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the circuit with the outcome of an allowed call
+func (b *breaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if success {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || (b.config.FailureThreshold > 0 && b.failures >= b.config.FailureThreshold) {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns closed, open or half-open
+func (b *breaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.config.OpenTimeout {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// breaker returns the circuit breaker for a handler path, creating it on first use
+func (node *Node) breaker(path string) *breaker {
+	path = strings.TrimLeft(path, "/")
+	node.breakersMu.Lock()
+	defer node.breakersMu.Unlock()
+	if node.breakers == nil {
+		node.breakers = make(map[string]*breaker)
+	}
+	b, ok := node.breakers[path]
+	if !ok {
+		b = newBreaker()
+		node.breakers[path] = b
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndProbes(t *testing.T) {
+	b := &breaker{config: BreakerConfig{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond}, state: CircuitClosed}
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("call %d refused while closed", i)
+		}
+		b.record(false)
+	}
+	if b.State() != CircuitOpen || b.allow() {
+		t.Fatalf("state after the threshold = %s", b.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state after the open timeout = %s", b.State())
+	}
+	if !b.allow() {
+		t.Fatal("probe refused")
+	}
+	if b.allow() {
+		t.Fatal("second call let through while the probe is running")
+	}
+	b.record(false)
+	if b.State() != CircuitOpen || b.allow() {
+		t.Fatalf("state after a failed probe = %s", b.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("probe refused")
+	}
+	b.record(true)
+	if b.State() != CircuitClosed || !b.allow() || !b.allow() {
+		t.Fatalf("state after a successful probe = %s", b.State())
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := &breaker{config: BreakerConfig{}, state: CircuitClosed}
+	for i := 0; i < 10; i++ {
+		b.record(false)
+	}
+	if !b.allow() || b.State() != CircuitClosed {
+		t.Fatalf("disabled breaker = %s", b.State())
+	}
+}
+
+func TestOpenCircuitShortCircuitsDispatch(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	SetBreakerConfig(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	defer SetBreakerConfig(BreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second})
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _, err := node.dispatchWithRetry("/fail", &Message{}, nil, 0); err == nil || status != 500 {
+		t.Fatalf("failing dispatch: %d %v", status, err)
+	}
+	if _, status, _, err := node.dispatchWithRetry("/fail", &Message{}, nil, 0); err != ErrCircuitOpen || status != CircuitOpenCode {
+		t.Fatalf("dispatch with the circuit open: %d %v", status, err)
+	}
+	if node.breaker("fail").State() != CircuitOpen || node.breaker("/echo").State() != CircuitClosed {
+		t.Fatal("circuits are not per path")
+	}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBufferSize = 1000
+	// maxBufferedDeliveries is how many times a buffered signal is delivered to a node which
+	// fails it before it is dead-lettered, so a signal its handler always fails cannot block the slot
+	maxBufferedDeliveries = 5
+)
+
+var (
+	errBufferFull    = errors.New("dropped from full buffer")
+	errBufferExpired = errors.New("expired in buffer")
+	errBufferDrained = errors.New("still buffered when the node was drained")
+)
+
+// BufferPolicy makes a slot keep its subscription while the node is unavailable.
+// Signals are queued and delivered in order once the node passes its health check again.
+type BufferPolicy struct {
+	MaxSize int `json:"max_size"` // signals kept, default 1000. The oldest is dropped when full
+	MaxAge  int `json:"max_age"`  // seconds a signal is kept, 0 for no limit
+}
+
+// size returns the number of signals kept
+func (p *BufferPolicy) size() int {
+	if p.MaxSize <= 0 {
+		return defaultBufferSize
+	}
+	return p.MaxSize
+}
+
+type bufferedSignal struct {
+	message    *Message
+	received   time.Time
+	deliveries int
+}
+
+// signalBuffer queues a buffered slot's signals while its node is unavailable
+type signalBuffer struct {
+	sync.Mutex
+	queue    []bufferedSignal
+	flushing bool
+}
+
+func slotKey(slot Slot) string {
+	return slot.Topic + "|" + slot.Group + "|" + slot.Path
+}
+
+// buffer returns the signal buffer for a slot, creating it on first use
+func (node *Node) buffer(slot Slot) *signalBuffer {
+	node.buffersMu.Lock()
+	defer node.buffersMu.Unlock()
+	if node.buffers == nil {
+		node.buffers = make(map[string]*signalBuffer)
+	}
+	buf, ok := node.buffers[slotKey(slot)]
+	if !ok {
+		buf = new(signalBuffer)
+		node.buffers[slotKey(slot)] = buf
+	}
+	return buf
+}
+
+// hold queues message if the node is unavailable or earlier signals are still waiting,
+// so deliveries stay in order. It reports false when message should be delivered now.
+func (buf *signalBuffer) hold(node *Node, slot Slot, message *Message) bool {
+	buf.Lock()
+	defer buf.Unlock()
+	if node.IsDraining() {
+		node.deadLetter(slot, message, errBufferDrained)
+		return true
+	}
+	if node.available() && len(buf.queue) == 0 && !buf.flushing {
+		return false
+	}
+	buf.expire(node, slot)
+	for len(buf.queue) >= slot.Buffer.size() {
+		node.deadLetter(slot, buf.queue[0].message, errBufferFull)
+		buf.queue = buf.queue[1:]
+	}
+	buf.queue = append(buf.queue, bufferedSignal{message: message, received: time.Now()})
+	return true
+}
+
+// requeue puts a signal the node failed back at the front of the queue, to be delivered
+// again after the next health check. It reports false, and does not queue the signal,
+// if it has failed too often or the node is draining. Like hold, it keeps the queue
+// within max_size: the signal is the oldest, so it is the one not queued when full.
+func (buf *signalBuffer) requeue(node *Node, slot Slot, signal bufferedSignal) bool {
+	signal.deliveries++
+	if signal.deliveries >= maxBufferedDeliveries || node.IsDraining() {
+		return false
+	}
+	buf.Lock()
+	defer buf.Unlock()
+	if len(buf.queue) >= slot.Buffer.size() {
+		return false
+	}
+	buf.queue = append([]bufferedSignal{signal}, buf.queue...)
+	return true
+}
+
+// discard dead-letters every queued signal with cause
+func (buf *signalBuffer) discard(node *Node, slot Slot, cause error) {
+	buf.Lock()
+	defer buf.Unlock()
+	for _, signal := range buf.queue {
+		node.deadLetter(slot, signal.message, cause)
+	}
+	buf.queue = nil
+}
+
+// expire drops signals older than the slot's max_age. Called with buf locked
+func (buf *signalBuffer) expire(node *Node, slot Slot) {
+	if slot.Buffer.MaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(slot.Buffer.MaxAge) * time.Second)
+	for len(buf.queue) > 0 && buf.queue[0].received.Before(cutoff) {
+		node.deadLetter(slot, buf.queue[0].message, errBufferExpired)
+		buf.queue = buf.queue[1:]
+	}
+}
+
+// Len returns the number of signals waiting
+func (buf *signalBuffer) Len() int {
+	buf.Lock()
+	defer buf.Unlock()
+	return len(buf.queue)
+}
+
+// flush delivers the slot's queued signals one at a time, stopping if the node goes down
+// again or fails a signal, which then waits for the next health check
+func (node *Node) flush(slot Slot) {
+	buf := node.buffer(slot)
+	buf.Lock()
+	if buf.flushing {
+		buf.Unlock()
+		return
+	}
+	buf.flushing = true
+	buf.Unlock()
+
+	for {
+		buf.Lock()
+		buf.expire(node, slot)
+		if len(buf.queue) == 0 || !node.available() || node.IsDraining() {
+			buf.flushing = false
+			buf.Unlock()
+			return
+		}
+		signal := buf.queue[0]
+		buf.queue = buf.queue[1:]
+		node.begin()
+		buf.Unlock()
+
+		requeued := node.deliverSignal(slot, signal)
+		node.end()
+		if requeued {
+			buf.Lock()
+			buf.flushing = false
+			buf.Unlock()
+			return
+		}
+	}
+}
+
+// flushBuffers starts delivering every buffered slot's queued signals
+func (node *Node) flushBuffers() {
+	for _, slot := range node.slots {
+		if slot.Buffer != nil && node.buffer(slot).Len() > 0 {
+			log.Println("Flushing buffered signals for", slot.Topic, slot.Path)
+			go node.flush(slot)
+		}
+	}
+}
+
+// discardBuffers dead-letters the signals queued for every buffered slot
+func (node *Node) discardBuffers() {
+	for _, slot := range node.slots {
+		if slot.Buffer != nil {
+			node.buffer(slot).discard(node, slot, errBufferDrained)
+		}
+	}
+}
+
+func validateBuffer(errs *ValidationErrors, field string, p *BufferPolicy) {
+	if p == nil {
+		return
+	}
+	if p.MaxSize < 0 {
+		errs.add(field+".buffer.max_size", "cannot be negative")
+	}
+	if p.MaxAge < 0 {
+		errs.add(field+".buffer.max_age", "cannot be negative")
+	}
+}
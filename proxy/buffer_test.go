@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBufferedSignalsSurviveFailuresAndAreDeadLetteredOnDrain(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "gilmour-deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileDeadLetters(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDeadLetterStore(store)
+	defer SetDeadLetterStore(nil)
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffered := Slot{Topic: "buffered", Path: "/fail", Buffer: &BufferPolicy{}}
+	unbuffered := Slot{Topic: "unbuffered", Path: "/fail"}
+	node.slots = []Slot{buffered, unbuffered}
+
+	signal := bufferedSignal{message: &Message{Data: "a"}, received: time.Now()}
+	if !node.deliverSignal(buffered, signal) {
+		t.Fatal("failed signal of a buffered slot was not queued again")
+	}
+	if n := node.buffer(buffered).Len(); n != 1 {
+		t.Fatalf("buffered = %d", n)
+	}
+	if node.deliverSignal(unbuffered, signal) {
+		t.Fatal("failed signal of an unbuffered slot was queued")
+	}
+	letters, _ := node.GetDeadLetters()
+	if len(letters) != 1 || letters[0].Topic != "unbuffered" {
+		t.Fatalf("dead letters before drain = %+v", letters)
+	}
+
+	node.Drain(0)
+	if n := node.buffer(buffered).Len(); n != 0 {
+		t.Fatalf("buffered after drain = %d", n)
+	}
+	letters, _ = node.GetDeadLetters()
+	if len(letters) != 2 || letters[1].Topic != "buffered" || letters[1].Error != errBufferDrained.Error() {
+		t.Fatalf("dead letters after drain = %+v", letters)
+	}
+}
+
+func TestRequeueGivesUp(t *testing.T) {
+	node := &Node{}
+	slot := Slot{Buffer: &BufferPolicy{}}
+	buf := new(signalBuffer)
+	signal := bufferedSignal{message: &Message{}, deliveries: maxBufferedDeliveries - 1}
+	if buf.requeue(node, slot, signal) {
+		t.Fatal("signal queued again after the last delivery")
+	}
+	signal.deliveries = 0
+	if !buf.requeue(node, slot, signal) || buf.Len() != 1 || buf.queue[0].deliveries != 1 {
+		t.Fatalf("queue after requeue = %+v", buf.queue)
+	}
+}
+
+func TestRequeueKeepsMaxSize(t *testing.T) {
+	node := &Node{}
+	slot := Slot{Buffer: &BufferPolicy{MaxSize: 2}}
+	buf := new(signalBuffer)
+	for i := 0; i < 2; i++ {
+		if !buf.requeue(node, slot, bufferedSignal{message: &Message{Data: i}}) {
+			t.Fatalf("signal %d not queued", i)
+		}
+	}
+	if buf.requeue(node, slot, bufferedSignal{message: &Message{Data: 2}}) {
+		t.Fatal("signal queued again into a full buffer")
+	}
+	if buf.Len() != 2 || buf.queue[0].message.Data != 1 {
+		t.Fatalf("queue = %+v", buf.queue)
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Statuses of a single item in a bulk subscription
+const (
+	SubscriptionOK         = "ok"
+	SubscriptionExists     = "already subscribed"
+	SubscriptionRolledBack = "rolled back"
+	SubscriptionSkipped    = "skipped"
+)
+
+// SubscriptionResult is the outcome for one service or slot of a bulk subscription
+type SubscriptionResult struct {
+	Topic  string `json:"topic"`
+	Group  string `json:"group"`
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+// SlotList decodes either a single slot object or an array of slots
+type SlotList []Slot
+
+func (l *SlotList) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var slot Slot
+		if err := json.Unmarshal(trimmed, &slot); err != nil {
+			return err
+		}
+		*l = SlotList{slot}
+		return nil
+	}
+	var list []Slot
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// isSingleService reports whether a JSON object is one service rather than a ServiceMap
+func isSingleService(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	topic, ok := fields["topic"]
+	return ok && len(topic) > 0 && topic[0] == '"'
+}
+
+// SubscribeServices adds all of services or none of them. Services the node already has are
+// left as they are. If any subscription fails, the ones made by this call are removed again.
+func (node *Node) SubscribeServices(services ServiceList) (results []SubscriptionResult, err error) {
+	if err = ValidateServices(services); err != nil {
+		return
+	}
+	results = make([]SubscriptionResult, len(services))
+	for i, service := range services {
+		results[i] = SubscriptionResult{Topic: string(service.Topic), Group: service.Group, Path: service.Path, Status: SubscriptionSkipped}
+	}
+	var added []int
+	for i, service := range services {
+		if serviceIndex(node.serviceList(), service) != -1 {
+			results[i].Status = SubscriptionExists
+			continue
+		}
+		if err = node.AddService(service); err != nil {
+			results[i].Status = err.Error()
+			break
+		}
+		results[i].Status = SubscriptionOK
+		added = append(added, i)
+	}
+	if err != nil {
+		for _, i := range added {
+			node.removeService(services[i])
+			results[i].Status = SubscriptionRolledBack
+		}
+	}
+	return
+}
+
+// SubscribeSlots adds all of slots or none of them, in the same way as SubscribeServices
+func (node *Node) SubscribeSlots(slots SlotList) (results []SubscriptionResult, err error) {
+	errs := ValidationErrors{}
+	for i, slot := range slots {
+		validateSlot(&errs, fmt.Sprintf("slots[%d]", i), slot)
+	}
+	if err = errs.err(); err != nil {
+		return
+	}
+	results = make([]SubscriptionResult, len(slots))
+	for i, slot := range slots {
+		results[i] = SubscriptionResult{Topic: slot.Topic, Group: slot.Group, Path: slot.Path, Status: SubscriptionSkipped}
+	}
+	var added []int
+	for i, slot := range slots {
+		if exists, _ := contains(node.slots, slot); exists {
+			results[i].Status = SubscriptionExists
+			continue
+		}
+		if err = node.AddSlot(slot); err != nil {
+			results[i].Status = err.Error()
+			break
+		}
+		results[i].Status = SubscriptionOK
+		added = append(added, i)
+	}
+	if err != nil {
+		for _, i := range added {
+			node.removeSlot(slots[i])
+			results[i].Status = SubscriptionRolledBack
+		}
+	}
+	return
+}
+
+// removeService unsubscribes exactly the service with the same topic, group and path
+func (node *Node) removeService(service Service) {
+	node.servicesMu.Lock()
+	defer node.servicesMu.Unlock()
+	if i := serviceIndex(node.services, service); i != -1 {
+		node.engine.UnsubscribeReply(string(service.Topic), node.services[i].Subscription)
+		services := append(ServiceList(nil), node.services[:i]...)
+		node.services = append(services, node.services[i+1:]...)
+		return
+	}
+	log.Println("Cannot roll back service", service.Topic, service.Path, ": not subscribed")
+}
+
+// removeSlot unsubscribes exactly the slot with the same topic, group and path
+func (node *Node) removeSlot(slot Slot) {
+	if exists, i := contains(node.slots, slot); exists {
+		node.engine.UnsubscribeSlot(slot.Topic, node.slots[i].Subscription)
+		node.slots = append(node.slots[:i], node.slots[i+1:]...)
+		return
+	}
+	log.Println("Cannot roll back slot", slot.Topic, slot.Path, ": not subscribed")
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// denySecrets makes subscriptions to secret.* fail, part way through a bulk subscription
+func denySecrets(t *testing.T) {
+	if err := SetPolicy(&Policy{Rules: []PolicyRule{{Effect: "deny", Topics: []string{"secret.*"}}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribeServicesRollsBack(t *testing.T) {
+	denySecrets(t)
+	defer SetPolicy(nil)
+	node := &Node{metrics: new(NodeMetrics)}
+	existing := Service{Topic: "sum", Group: "math", Path: "/sum"}
+	if err := node.AddService(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := node.SubscribeServices(ServiceList{
+		{Topic: "count", Group: "math", Path: "/count"},
+		existing,
+		{Topic: "secret.keys", Group: "math", Path: "/keys"},
+		{Topic: "index", Group: "math", Path: "/index"},
+	})
+	if err == nil {
+		t.Fatal("denied subscription did not fail the bulk subscription")
+	}
+	statuses := []string{SubscriptionRolledBack, SubscriptionExists, err.Error(), SubscriptionSkipped}
+	for i, r := range results {
+		if r.Status != statuses[i] {
+			t.Errorf("results[%d] = %+v, want %s", i, r, statuses[i])
+		}
+	}
+	if services := node.serviceList(); len(services) != 1 || !sameService(services[0], existing) {
+		t.Fatalf("services after the rollback = %+v", services)
+	}
+}
+
+func TestSubscribeSlotsRollsBack(t *testing.T) {
+	denySecrets(t)
+	defer SetPolicy(nil)
+	node := &Node{metrics: new(NodeMetrics)}
+
+	results, err := node.SubscribeSlots(SlotList{
+		{Topic: "log", Path: "/log"},
+		{Topic: "audit.*", Path: "/audit"},
+		{Topic: "secret.keys", Path: "/keys"},
+	})
+	if err == nil {
+		t.Fatal("denied subscription did not fail the bulk subscription")
+	}
+	if results[0].Status != SubscriptionRolledBack || results[1].Status != SubscriptionRolledBack || results[2].Status != err.Error() {
+		t.Errorf("results = %+v", results)
+	}
+	if len(node.slots) != 0 {
+		t.Fatalf("slots after the rollback = %+v", node.slots)
+	}
+
+	results, err = node.SubscribeSlots(SlotList{{Topic: "log", Path: "/log"}, {Topic: "audit.*", Path: "/audit"}})
+	if err != nil || len(node.slots) != 2 || results[0].Status != SubscriptionOK {
+		t.Fatalf("subscription without a denied slot: %+v, %v", results, err)
+	}
+}
+
+func TestSubscribeServicesValidatesFirst(t *testing.T) {
+	node := &Node{metrics: new(NodeMetrics)}
+	_, err := node.SubscribeServices(ServiceList{{Topic: "count", Group: "math", Path: "/count"}, {Topic: "sum.*"}})
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Fatalf("invalid service: %v", err)
+	}
+	if services := node.serviceList(); len(services) != 0 {
+		t.Fatalf("services subscribed from an invalid list: %+v", services)
+	}
+}
+
+func TestSlotListDecoding(t *testing.T) {
+	for body, n := range map[string]int{
+		`{"topic": "log", "path": "/log"}`:                                 1,
+		`[{"topic": "log", "path": "/log"}, {"topic": "a", "path": "/a"}]`: 2,
+	} {
+		var slots SlotList
+		if err := json.Unmarshal([]byte(body), &slots); err != nil || len(slots) != n || slots[0].Topic != "log" {
+			t.Errorf("%s: %+v, %v", body, slots, err)
+		}
+	}
+}
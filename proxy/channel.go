@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	G "gopkg.in/gilmour-libs/gilmour-e-go.v4"
+)
+
+// Frame types of the node channel, which runs over a WebSocket or a gRPC stream
+const (
+	FrameRegister       = "register"        // node → proxy, first frame: register or resume a node
+	FrameRegistered     = "registered"      // proxy → node: the node's id and secret
+	FrameAddServices    = "add_services"    // node → proxy
+	FrameAddSlots       = "add_slots"       // node → proxy
+	FrameRemoveServices = "remove_services" // node → proxy, by topic and optional path
+	FrameRemoveSlots    = "remove_slots"    // node → proxy, by topic and optional path
+	FrameRequest        = "request"         // node → proxy: publish a request
+	FrameMessage        = "message"         // proxy → node: one message of a streamed response
+	FrameResponse       = "response"        // proxy → node: the whole response to a request
+	FrameSignal         = "signal"          // node → proxy: publish a signal
+	FrameDispatch       = "dispatch"        // proxy → node: call a service or slot handler
+	FrameReply          = "reply"           // node → proxy: the handler's reply to a dispatch
+	FrameResult         = "result"          // proxy → node: outcome of a subscription or signal frame
+	FrameError          = "error"           // proxy → node: a frame could not be handled
+)
+
+// Transports of channel nodes
+const (
+	TransportWebSocket = "websocket"
+	TransportGRPC      = "grpc"
+)
+
+const channelReconnectGrace = 5 * time.Minute
+
+// ErrNotConnected is returned for dispatches to a channel node which has disconnected
+var ErrNotConnected = errors.New("Node is not connected")
+
+// Frame is one JSON message on the node channel. ID correlates a frame with its answer:
+// a dispatch with its reply, or a request, subscription or signal frame with its result.
+type Frame struct {
+	Type     string               `json:"type"`
+	ID       string               `json:"id,omitempty"`
+	NodeID   NodeID               `json:"node_id,omitempty"`
+	Secret   string               `json:"secret,omitempty"`
+	Node     *NodeReq             `json:"node,omitempty"`
+	Services ServiceList          `json:"services,omitempty"`
+	Slots    SlotList             `json:"slots,omitempty"`
+	Topic    string               `json:"topic,omitempty"`
+	Path     string               `json:"path,omitempty"`
+	Request  *Request             `json:"request,omitempty"`
+	Stream   bool                 `json:"stream,omitempty"`
+	Response *RequestResponse     `json:"response,omitempty"`
+	Message  *Message             `json:"message,omitempty"`
+	Data     interface{}          `json:"data,omitempty"`
+	Code     int                  `json:"code,omitempty"`
+	Results  []SubscriptionResult `json:"results,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// FrameStream carries frames for one channel connection. grpc.ServerStream satisfies it.
+// RecvMsg is only called from one goroutine, and SendMsg calls are serialised.
+type FrameStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+// channelConn is one channel connection. Dispatches wait in pending for the reply with the same id.
+type channelConn struct {
+	stream    FrameStream
+	writeMu   sync.Mutex
+	pendingMu sync.Mutex
+	pending   map[string]chan Frame
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *channelConn) send(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.closed:
+		return ErrNotConnected
+	default:
+	}
+	return c.stream.SendMsg(&f)
+}
+
+// close ends ServeChannel for the connection, which makes the transport close it
+func (c *channelConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// nodeChannel is the transport of a node registered over the channel.
+// conn is nil while the node is disconnected.
+type nodeChannel struct {
+	sync.Mutex
+	transport    string
+	conn         *channelConn
+	disconnected time.Time
+}
+
+func (ch *nodeChannel) current() *channelConn {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.conn
+}
+
+func (ch *nodeChannel) attach(c *channelConn) {
+	ch.Lock()
+	old := ch.conn
+	ch.conn = c
+	ch.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func (ch *nodeChannel) detach(c *channelConn) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.conn == c {
+		ch.conn = nil
+		ch.disconnected = time.Now()
+	}
+}
+
+// status stands in for the health check: ok while connected, unavailable while disconnected,
+// and gone once the node has not reconnected within channelReconnectGrace
+func (ch *nodeChannel) status() Status {
+	ch.Lock()
+	defer ch.Unlock()
+	switch {
+	case ch.conn != nil:
+		return 200
+	case time.Since(ch.disconnected) > channelReconnectGrace:
+		return 404
+	}
+	return 403
+}
+
+func (ch *nodeChannel) close() {
+	if c := ch.current(); c != nil {
+		c.close()
+	}
+}
+
+// channelDispatch sends a dispatch frame and waits for the node's reply. As with HTTP handlers,
+// a reply code of 500 or more is returned as an error.
+func (node *Node) channelDispatch(ctx context.Context, path string, message *Message) (data interface{}, status int, err error) {
+	c := node.channel.current()
+	if c == nil {
+		return nil, 0, ErrNotConnected
+	}
+	id := newRequestID()
+	reply := make(chan Frame, 1)
+	c.pendingMu.Lock()
+	c.pending[id] = reply
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	if err = c.send(Frame{Type: FrameDispatch, ID: id, Path: path, Message: message}); err != nil {
+		return
+	}
+	select {
+	case f := <-reply:
+		status = f.Code
+		if status == 0 {
+			status = 200
+		}
+		if status >= 500 {
+			err = fmt.Errorf("%s replied %d: %s", path, status, f.Error)
+			return
+		}
+		return f.Data, status, nil
+	case <-c.closed:
+		return nil, 0, ErrNotConnected
+	case <-ctx.Done():
+		return nil, 0, fmt.Errorf("%s did not reply: %v", path, ctx.Err())
+	}
+}
+
+// CreateChannelNode registers a node whose handlers are called over the channel instead
+// of HTTP. transport names how it connects. It is not connected until ServeChannel
+// attaches a connection.
+func CreateChannelNode(nodeReq *NodeReq, engine *G.Gilmour, transport string) (*Node, error) {
+	errs := ValidationErrors{}
+	if nodeReq.Port != "" || nodeReq.URL != "" || nodeReq.Socket != "" || nodeReq.TLS != nil {
+		errs.add("node", "port, url, socket and tls are not used over "+transport)
+	}
+	nodeReq.validateOptions(&errs)
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	node, err := newNode(nodeReq, engine)
+	if err != nil {
+		return nil, err
+	}
+	node.channel = &nodeChannel{transport: transport, disconnected: time.Now()}
+	node.status = 200
+	err = nMap.Put(node.id, node)
+	return node, err
+}
+
+// Transport returns how the node's handlers are called: "http", or the channel's transport
+func (node *Node) Transport() string {
+	if node.channel != nil {
+		return node.channel.transport
+	}
+	return "http"
+}
+
+// ServeChannel runs the node channel over stream until it ends or a newer connection for the
+// same node replaces it. The first frame registers a new node, or resumes one after a reconnect
+// with its node_id and secret. register is called to create, start and watch a new node.
+func ServeChannel(stream FrameStream, cred *Credential, register func(*NodeReq) (*Node, error)) {
+	c := &channelConn{stream: stream, pending: make(map[string]chan Frame), closed: make(chan struct{})}
+	defer func() {
+		// The stream must not be written to once it is handed back to the transport
+		c.close()
+		c.writeMu.Lock()
+		c.writeMu.Unlock()
+	}()
+
+	var first Frame
+	if err := stream.RecvMsg(&first); err != nil {
+		log.Println("Channel closed before registering:", err)
+		return
+	}
+	if first.Type != FrameRegister {
+		c.send(Frame{Type: FrameError, ID: first.ID, Error: "the first frame must be " + FrameRegister})
+		return
+	}
+	node, err := channelRegister(first, cred, register)
+	if err != nil {
+		log.Println("Channel registration failed:", err)
+		c.send(Frame{Type: FrameError, ID: first.ID, Error: err.Error()})
+		return
+	}
+	node.channel.attach(c)
+	defer node.channel.detach(c)
+	if err = c.send(Frame{Type: FrameRegistered, ID: first.ID, NodeID: node.id, Secret: node.secret}); err != nil {
+		return
+	}
+	log.Println("Node", node.id, "connected over", node.channel.transport)
+
+	frames := make(chan Frame)
+	go func() {
+		defer close(frames)
+		for {
+			var f Frame
+			if err := stream.RecvMsg(&f); err != nil {
+				log.Println("Node", node.id, "disconnected:", err)
+				return
+			}
+			select {
+			case frames <- f:
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				return
+			}
+			node.handleFrame(c, f)
+		case <-c.closed:
+			log.Println("Node", node.id, "reconnected, closing the old connection")
+			return
+		}
+	}
+}
+
+// channelRegister creates a node for a register frame, or finds the node it resumes
+func channelRegister(f Frame, cred *Credential, register func(*NodeReq) (*Node, error)) (*Node, error) {
+	if f.NodeID == "" {
+		nodeReq := f.Node
+		if nodeReq == nil {
+			nodeReq = new(NodeReq)
+		}
+		return register(nodeReq)
+	}
+	node, err := nMap.Get(f.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node.channel == nil || subtle.ConstantTimeCompare([]byte(f.Secret), []byte(node.secret)) != 1 {
+		return nil, errors.New("Node id or secret is wrong")
+	}
+	if err = node.Authorize(cred); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// handleFrame acts on one frame from the node. Requests and signals are handled in the
+// background so that replies to dispatches are not held up behind them.
+func (node *Node) handleFrame(c *channelConn, f Frame) {
+	result := Frame{Type: FrameResult, ID: f.ID}
+	var err error
+	switch f.Type {
+	case FrameReply:
+		// Only the first reply to a dispatch is taken, so the send never blocks
+		c.pendingMu.Lock()
+		reply, ok := c.pending[f.ID]
+		delete(c.pending, f.ID)
+		c.pendingMu.Unlock()
+		if ok {
+			reply <- f
+		} else {
+			log.Println("Reply", f.ID, "from node", node.id, "matches no dispatch")
+		}
+		return
+	case FrameRequest:
+		go node.channelRequest(c, f)
+		return
+	case FrameSignal:
+		go node.channelSignal(c, f)
+		return
+	case FrameAddServices:
+		result.Results, err = node.SubscribeServices(f.Services)
+	case FrameAddSlots:
+		result.Results, err = node.SubscribeSlots(f.Slots)
+	case FrameRemoveServices:
+		var removed []Service
+		removed, err = node.RemoveServices(GilmourTopic(f.Topic), f.Path)
+		result.Data = map[string]int{"removed": len(removed)}
+	case FrameRemoveSlots:
+		err = node.RemoveSlot(Slot{Topic: f.Topic, Path: f.Path})
+	default:
+		c.send(Frame{Type: FrameError, ID: f.ID, Error: fmt.Sprintf("Unknown frame type %q", f.Type)})
+		return
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if err = c.send(result); err != nil {
+		log.Println(err)
+	}
+}
+
+func (node *Node) channelRequest(c *channelConn, f Frame) {
+	if f.Request == nil {
+		c.send(Frame{Type: FrameError, ID: f.ID, Error: "request required"})
+		return
+	}
+	if err := node.AllowPublish(f.Request.Topics()...); err != nil {
+		c.send(Frame{Type: FrameError, ID: f.ID, Code: BusyCode, Error: err.Error()})
+		return
+	}
+	var emit func(RequestResponseMessage)
+	if f.Stream {
+		emit = func(m RequestResponseMessage) {
+			c.send(Frame{Type: FrameMessage, ID: f.ID, Data: m.Data, Code: m.Code})
+		}
+	}
+	response := node.RequestServiceStream(*f.Request, emit)
+	if err := c.send(Frame{Type: FrameResponse, ID: f.ID, Response: &response}); err != nil {
+		log.Println(err)
+	}
+}
+
+func (node *Node) channelSignal(c *channelConn, f Frame) {
+	result := Frame{Type: FrameResult, ID: f.ID}
+	if err := node.AllowPublish(f.Topic); err != nil {
+		result.Code = BusyCode
+		result.Error = err.Error()
+	} else if sender, err := node.PublishSignal(f.Topic, f.Data); err != nil {
+		if _, denied := err.(PolicyDenied); denied {
+			result.Code = PolicyDeniedCode
+		}
+		result.Error = err.Error()
+	} else {
+		result.Data = map[string]string{"sender": sender}
+	}
+	if err := c.send(result); err != nil {
+		log.Println(err)
+	}
+}
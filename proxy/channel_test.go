@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// frameRecorder is a FrameStream which keeps the frames sent to the node
+type frameRecorder struct {
+	sent chan Frame
+}
+
+func (r *frameRecorder) SendMsg(m interface{}) error {
+	r.sent <- *m.(*Frame)
+	return nil
+}
+
+func (r *frameRecorder) RecvMsg(m interface{}) error {
+	select {}
+}
+
+func TestDuplicateRepliesDoNotBlock(t *testing.T) {
+	stream := &frameRecorder{sent: make(chan Frame, 1)}
+	c := &channelConn{stream: stream, pending: make(map[string]chan Frame), closed: make(chan struct{})}
+	node := &Node{id: "n1", channel: &nodeChannel{transport: TransportWebSocket}}
+	node.channel.attach(c)
+
+	type result struct {
+		data interface{}
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		data, _, err := node.channelDispatch(context.Background(), "/h", &Message{})
+		done <- result{data, err}
+	}()
+	dispatch := <-stream.sent
+
+	handled := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			node.handleFrame(c, Frame{Type: FrameReply, ID: dispatch.ID, Data: i})
+		}
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a duplicate reply blocked the connection")
+	}
+	if r := <-done; r.err != nil || r.data != 0 {
+		t.Fatalf("dispatch = %+v", r)
+	}
+}
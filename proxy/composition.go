@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	G "gopkg.in/gilmour-libs/gilmour-e-go.v4"
+)
+
+// Composition is a composition_spec: a request to a topic, or a gilmour composition
+// of further specs. Exactly one field is set.
+type Composition struct {
+	Topic    string        `json:"topic,omitempty"`
+	Pipe     []Composition `json:"pipe,omitempty"`     // each step gets the output of the one before
+	AndAnd   []Composition `json:"and_and,omitempty"`  // like pipe, but stops at the first error
+	OrOr     []Composition `json:"or_or,omitempty"`    // stops at the first step which succeeds
+	Batch    []Composition `json:"batch,omitempty"`    // every step in turn, with the same input
+	Parallel []Composition `json:"parallel,omitempty"` // every step at once, with the same input
+}
+
+// steps returns the kind of composition and its steps, or "" for a topic
+func (c *Composition) steps() (string, []Composition) {
+	switch {
+	case c.Pipe != nil:
+		return "pipe", c.Pipe
+	case c.AndAnd != nil:
+		return "and_and", c.AndAnd
+	case c.OrOr != nil:
+		return "or_or", c.OrOr
+	case c.Batch != nil:
+		return "batch", c.Batch
+	case c.Parallel != nil:
+		return "parallel", c.Parallel
+	}
+	return "", nil
+}
+
+func (c *Composition) validate(errs *ValidationErrors, field string) {
+	set := 0
+	for _, s := range [][]Composition{c.Pipe, c.AndAnd, c.OrOr, c.Batch, c.Parallel} {
+		if s != nil {
+			set++
+		}
+	}
+	if c.Topic != "" {
+		set++
+	}
+	if set != 1 {
+		errs.add(field, "must have exactly one of topic, pipe, and_and, or_or, batch or parallel")
+		return
+	}
+	if c.Topic != "" {
+		if strings.Contains(c.Topic, "*") {
+			errs.add(field+".topic", "cannot be a wildcard")
+		}
+		return
+	}
+	kind, steps := c.steps()
+	if len(steps) == 0 {
+		errs.add(field+"."+kind, "is required")
+	}
+	for i := range steps {
+		steps[i].validate(errs, fmt.Sprintf("%s.%s[%d]", field, kind, i))
+	}
+}
+
+// topics returns every topic the composition sends requests to
+func (c *Composition) topics() []string {
+	if c.Topic != "" {
+		return []string{c.Topic}
+	}
+	var topics []string
+	_, steps := c.steps()
+	for i := range steps {
+		topics = append(topics, steps[i].topics()...)
+	}
+	return topics
+}
+
+// executable builds the gilmour composition
+func (c *Composition) executable(engine *G.Gilmour) G.Executable {
+	if c.Topic != "" {
+		return engine.NewRequest(c.Topic)
+	}
+	kind, steps := c.steps()
+	cmds := make([]G.Executable, len(steps))
+	for i := range steps {
+		cmds[i] = steps[i].executable(engine)
+	}
+	switch kind {
+	case "pipe":
+		return engine.NewPipe(cmds...)
+	case "and_and":
+		return engine.NewAndAnd(cmds...)
+	case "or_or":
+		return engine.NewOrOr(cmds...)
+	case "batch":
+		return engine.NewBatch(cmds...)
+	}
+	return engine.NewParallel(cmds...)
+}
+
+// executeComposition runs the request's composition. The steps of a batch or parallel
+// composition are run by the proxy, so that each one's response is added as it arrives.
+func (node *Node) executeComposition(c *Composition, message Message, add func(RequestResponseMessage)) {
+	switch {
+	case c.Batch != nil:
+		for i := range c.Batch {
+			node.execute(c.Batch[i].executable(node.engine), message, add)
+		}
+	case c.Parallel != nil:
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := range c.Parallel {
+			wg.Add(1)
+			go func(step G.Executable) {
+				defer wg.Done()
+				node.execute(step, message, func(m RequestResponseMessage) {
+					mu.Lock()
+					defer mu.Unlock()
+					add(m)
+				})
+			}(c.Parallel[i].executable(node.engine))
+		}
+		wg.Wait()
+	default:
+		node.execute(c.executable(node.engine), message, add)
+	}
+}
+
+// execute sends message to cmd and adds every message of its response
+func (node *Node) execute(cmd G.Executable, message Message, add func(RequestResponseMessage)) {
+	resp, err := cmd.Execute(G.NewMessage().SetData(message))
+	if err != nil {
+		log.Println("Error running service request: ", err)
+		add(errorMessage(err, 500))
+		return
+	}
+	for i := 0; i < resp.Cap(); i++ {
+		msg := resp.Next()
+		if msg == nil {
+			break
+		}
+		m := RequestResponseMessage{Code: msg.GetCode()}
+		if err := msg.GetData(&m.Data); err != nil {
+			log.Println("Error receiving response: ", err)
+		}
+		m.unwrapReplyMeta()
+		add(m)
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompositionValidate(t *testing.T) {
+	valid := &Composition{Pipe: []Composition{
+		{Topic: "fetch"},
+		{Parallel: []Composition{{Topic: "count"}, {Topic: "index"}}},
+	}}
+	var errs ValidationErrors
+	valid.validate(&errs, "composition")
+	if len(errs) > 0 {
+		t.Fatalf("valid composition: %v", errs)
+	}
+	if topics := valid.topics(); !reflect.DeepEqual(topics, []string{"fetch", "count", "index"}) {
+		t.Errorf("topics = %v", topics)
+	}
+
+	for _, c := range []*Composition{
+		{},
+		{Topic: "a", Pipe: []Composition{{Topic: "b"}}},
+		{Batch: []Composition{}},
+		{Parallel: []Composition{{Topic: "a.*"}}},
+		{OrOr: []Composition{{AndAnd: []Composition{{}}}}},
+	} {
+		errs = nil
+		c.validate(&errs, "composition")
+		if len(errs) == 0 {
+			t.Errorf("invalid composition %+v accepted", c)
+		}
+	}
+}
+
+func TestCompositionTopicsAreAuthorized(t *testing.T) {
+	if err := SetPolicy(&Policy{Rules: []PolicyRule{{Effect: "deny", Topics: []string{"secret.*"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPolicy(nil)
+	node := &Node{metrics: new(NodeMetrics)}
+	response := node.RequestService(Request{Composition: &Composition{AndAnd: []Composition{
+		{Topic: "public"},
+		{Topic: "secret.keys"},
+	}}})
+	if response.Code != PolicyDeniedCode || response.Length != 1 {
+		t.Fatalf("composition with a denied topic: %+v", response)
+	}
+
+	response = node.RequestService(Request{Topic: "public", Composition: &Composition{Topic: "public"}})
+	if response.Code != 400 {
+		t.Fatalf("topic with composition: %+v", response)
+	}
+}
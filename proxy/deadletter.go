@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoDeadLetterStore is returned by the dead-letter operations when no store is configured
+var ErrNoDeadLetterStore = errors.New("Dead-letter store not configured")
+
+// DeadLetter is a slot signal which could not be delivered to its node
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	NodeID    NodeID    `json:"node_id"`
+	Topic     string    `json:"topic"`
+	Path      string    `json:"path"`
+	Payload   *Message  `json:"payload"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DeadLetterStore keeps undeliverable slot signals per node
+type DeadLetterStore interface {
+	Push(DeadLetter) error
+	List(NodeID) ([]DeadLetter, error)
+	Remove(NodeID, []string) error
+	Purge(NodeID) error
+}
+
+var deadLetters DeadLetterStore
+
+// SetDeadLetterStore enables dead-lettering of failed slot deliveries. nil disables it
+func SetDeadLetterStore(store DeadLetterStore) {
+	deadLetters = store
+}
+
+// deadLetter records a failed delivery of message to slot
+func (node *Node) deadLetter(slot Slot, message *Message, cause error) {
+	if deadLetters == nil {
+		return
+	}
+	dl := DeadLetter{
+		ID:        newRequestID(),
+		NodeID:    node.id,
+		Topic:     slot.Topic,
+		Path:      slot.Path,
+		Payload:   message,
+		Error:     cause.Error(),
+		Timestamp: time.Now().UTC(),
+	}
+	if err := deadLetters.Push(dl); err != nil {
+		log.Println("Cannot store dead letter: ", err)
+	}
+}
+
+// GetDeadLetters returns the node's undelivered slot signals, oldest first
+func (node *Node) GetDeadLetters() ([]DeadLetter, error) {
+	if deadLetters == nil {
+		return nil, ErrNoDeadLetterStore
+	}
+	return deadLetters.List(node.id)
+}
+
+// ReplayDeadLetters dispatches dead letters to the node again, all of them if ids is empty.
+// Delivered letters are removed from the store, failed ones are kept.
+func (node *Node) ReplayDeadLetters(ids []string) (replayed int, failed int, err error) {
+	letters, err := node.GetDeadLetters()
+	if err != nil {
+		return
+	}
+	var done []string
+	for _, dl := range filterDeadLetters(letters, ids) {
+		if _, _, _, err := node.dispatchWithRetry(dl.Path, dl.Payload, nil, 0); err != nil {
+			log.Println("Replay of dead letter", dl.ID, "failed: ", err)
+			failed++
+			continue
+		}
+		done = append(done, dl.ID)
+		replayed++
+	}
+	if len(done) > 0 {
+		err = deadLetters.Remove(node.id, done)
+	}
+	return
+}
+
+// PurgeDeadLetters drops dead letters without delivering them, all of them if ids is empty
+func (node *Node) PurgeDeadLetters(ids []string) error {
+	if deadLetters == nil {
+		return ErrNoDeadLetterStore
+	}
+	if len(ids) == 0 {
+		return deadLetters.Purge(node.id)
+	}
+	return deadLetters.Remove(node.id, ids)
+}
+
+func filterDeadLetters(letters []DeadLetter, ids []string) []DeadLetter {
+	if len(ids) == 0 {
+		return letters
+	}
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	var matched []DeadLetter
+	for _, dl := range letters {
+		if want[dl.ID] {
+			matched = append(matched, dl)
+		}
+	}
+	return matched
+}
+
+// redisDeadLetters keeps each node's dead letters in a Redis list
+type redisDeadLetters struct {
+	pool *redis.Pool
+}
+
+// NewRedisDeadLetters returns a store backed by the Redis server at addr
+func NewRedisDeadLetters(addr string) DeadLetterStore {
+	return &redisDeadLetters{pool: &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}}
+}
+
+func deadLetterKey(id NodeID) string {
+	return "gilmour.proxy.deadletters." + string(id)
+}
+
+func (r *redisDeadLetters) Push(dl DeadLetter) error {
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("RPUSH", deadLetterKey(dl.NodeID), js)
+	return err
+}
+
+func (r *redisDeadLetters) raw(id NodeID) ([]string, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("LRANGE", deadLetterKey(id), 0, -1))
+}
+
+func (r *redisDeadLetters) List(id NodeID) ([]DeadLetter, error) {
+	entries, err := r.raw(id)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, e := range entries {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(e), &dl); err != nil {
+			log.Println("Skipping unreadable dead letter: ", err)
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	return letters, nil
+}
+
+func (r *redisDeadLetters) Remove(id NodeID, ids []string) error {
+	entries, err := r.raw(id)
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool)
+	for _, i := range ids {
+		remove[i] = true
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	for _, e := range entries {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(e), &dl); err != nil || !remove[dl.ID] {
+			continue
+		}
+		if _, err := conn.Do("LREM", deadLetterKey(id), 1, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisDeadLetters) Purge(id NodeID) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", deadLetterKey(id))
+	return err
+}
+
+// fileDeadLetters keeps each node's dead letters in a JSON lines file under dir
+type fileDeadLetters struct {
+	sync.Mutex
+	dir string
+}
+
+// NewFileDeadLetters returns a store writing to files in dir, creating it if needed
+func NewFileDeadLetters(dir string) (DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileDeadLetters{dir: dir}, nil
+}
+
+func (f *fileDeadLetters) path(id NodeID) string {
+	return filepath.Join(f.dir, string(id)+".jsonl")
+}
+
+func (f *fileDeadLetters) Push(dl DeadLetter) error {
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	file, err := os.OpenFile(f.path(dl.NodeID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(js, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *fileDeadLetters) List(id NodeID) ([]DeadLetter, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.read(id)
+}
+
+func (f *fileDeadLetters) read(id NodeID) ([]DeadLetter, error) {
+	file, err := os.Open(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			log.Println("Skipping unreadable dead letter: ", err)
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	return letters, scanner.Err()
+}
+
+func (f *fileDeadLetters) Remove(id NodeID, ids []string) error {
+	f.Lock()
+	defer f.Unlock()
+	letters, err := f.read(id)
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool)
+	for _, i := range ids {
+		remove[i] = true
+	}
+	tmp := f.path(id) + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, dl := range letters {
+		if remove[dl.ID] {
+			continue
+		}
+		if err = enc.Encode(dl); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(id))
+}
+
+func (f *fileDeadLetters) Purge(id NodeID) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
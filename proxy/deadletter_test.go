@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeRedis answers the list commands redisDeadLetters sends
+type fakeRedis struct {
+	lists map[string][]string
+}
+
+func (f *fakeRedis) Close() error                               { return nil }
+func (f *fakeRedis) Err() error                                 { return nil }
+func (f *fakeRedis) Send(cmd string, args ...interface{}) error { return errors.New("not supported") }
+func (f *fakeRedis) Flush() error                               { return nil }
+func (f *fakeRedis) Receive() (interface{}, error)              { return nil, errors.New("not supported") }
+
+func (f *fakeRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" { // sent by the pool when a connection is returned
+		return nil, nil
+	}
+	key := args[0].(string)
+	list := f.lists[key]
+	switch cmd {
+	case "RPUSH":
+		f.lists[key] = append(list, string(args[1].([]byte)))
+		return int64(len(f.lists[key])), nil
+	case "LRANGE":
+		values := make([]interface{}, len(list))
+		for i, v := range list {
+			values[i] = []byte(v)
+		}
+		return values, nil
+	case "LREM":
+		for i, v := range list {
+			if v == args[2].(string) {
+				f.lists[key] = append(list[:i:i], list[i+1:]...)
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	case "DEL":
+		delete(f.lists, key)
+		return int64(1), nil
+	}
+	return nil, errors.New("unknown command " + cmd)
+}
+
+func testDeadLetterStore(t *testing.T, store DeadLetterStore) {
+	node := &Node{id: "n1"}
+	SetDeadLetterStore(store)
+	defer SetDeadLetterStore(nil)
+
+	for _, topic := range []string{"a", "b", "c"} {
+		node.deadLetter(Slot{Topic: topic, Path: "/" + topic}, &Message{Data: topic}, errors.New("failed"))
+	}
+	(&Node{id: "n2"}).deadLetter(Slot{Topic: "other"}, &Message{}, errors.New("failed"))
+
+	letters, err := node.GetDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 3 || letters[0].Topic != "a" || letters[2].Topic != "c" || letters[1].Payload.Data != "b" {
+		t.Fatalf("letters = %+v", letters)
+	}
+	if letters[0].ID == letters[1].ID || letters[1].ID == letters[2].ID {
+		t.Fatalf("letters share an id: %+v", letters)
+	}
+
+	if err = node.PurgeDeadLetters([]string{letters[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := node.GetDeadLetters()
+	if len(left) != 2 || left[0].ID != letters[0].ID || left[1].ID != letters[2].ID {
+		t.Fatalf("after removing %s: %+v", letters[1].ID, left)
+	}
+
+	if err = node.PurgeDeadLetters(nil); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ = node.GetDeadLetters(); len(left) != 0 {
+		t.Fatalf("after purge: %+v", left)
+	}
+	if other, _ := (&Node{id: "n2"}).GetDeadLetters(); len(other) != 1 {
+		t.Fatalf("another node's letters = %+v", other)
+	}
+}
+
+func TestRedisDeadLetters(t *testing.T) {
+	conn := &fakeRedis{lists: make(map[string][]string)}
+	testDeadLetterStore(t, &redisDeadLetters{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) { return conn, nil },
+	}})
+}
+
+func TestFileDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gilmour-deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileDeadLetters(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDeadLetterStore(t, store)
+}
+
+func TestDeleteNodePurgesDeadLetters(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	conn := &fakeRedis{lists: make(map[string][]string)}
+	SetDeadLetterStore(&redisDeadLetters{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) { return conn, nil },
+	}})
+	defer SetDeadLetterStore(nil)
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.deadLetter(Slot{Topic: "a"}, &Message{}, errors.New("failed"))
+	if len(conn.lists) != 1 {
+		t.Fatalf("lists = %v", conn.lists)
+	}
+	DeleteNode(node, true, 0)
+	if len(conn.lists) != 0 {
+		t.Fatalf("dead letters left after delete: %v", conn.lists)
+	}
+}
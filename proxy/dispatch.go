@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// dispatch posts message to the node handler at path and decodes its JSON reply.
+// status is 0 when no response was received, e.g. when ctx is done first. A 5xx response
+// is returned as an error. The response body is always drained and closed so the
+// connection returns to the pool.
+func (node *Node) dispatch(ctx context.Context, path string, message *Message) (data interface{}, status int, err error) {
+	m := node.metrics
+	atomic.AddInt64(&m.Dispatches, 1)
+	atomic.AddInt64(&m.InFlight, 1)
+	defer atomic.AddInt64(&m.InFlight, -1)
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&m.Failures, 1)
+		}
+	}()
+	if node.channel != nil {
+		return node.channelDispatch(ctx, path, message)
+	}
+
+	mJSON, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	requester := node.endpoint(path)
+	log.Println(requester)
+	req, err := http.NewRequest("POST", requester, bytes.NewReader(mJSON))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	node.sign(req, mJSON)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, m.trace()))
+
+	hndlrResp, err := node.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer hndlrResp.Body.Close()
+	status = hndlrResp.StatusCode
+	body, err := node.readResponse(hndlrResp.Body)
+	if err != nil {
+		return
+	}
+	log.Println("Request: ", requester, "Response", hndlrResp.Status)
+	if status >= 500 {
+		err = fmt.Errorf("%s responded %s", requester, hndlrResp.Status)
+		return
+	}
+	err = json.Unmarshal(body, &data)
+	return
+}
+
+// dispatchWithRetry calls dispatch until it succeeds or the retry policy gives up.
+// All attempts together are limited to timeout (seconds, 0 for the default dispatch
+// timeout): it is the deadline of every dispatch, and no retry is started after it.
+func (node *Node) dispatchWithRetry(path string, message *Message, policy *RetryPolicy, timeout int) (data interface{}, status int, attempts int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dispatchTimeout(timeout))
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	circuit := node.breaker(path)
+	for attempts = 1; ; attempts++ {
+		if !circuit.allow() {
+			atomic.AddInt64(&node.metrics.Tripped, 1)
+			return nil, CircuitOpenCode, attempts - 1, ErrCircuitOpen
+		}
+		message.Attempt = attempts
+		data, status, err = node.dispatch(ctx, path, message)
+		circuit.record(err == nil)
+		if err == nil || attempts >= policy.attempts() || !policy.retryable(status) {
+			return
+		}
+		wait := policy.backoff(attempts)
+		if time.Now().Add(wait).After(deadline) {
+			return
+		}
+		atomic.AddInt64(&node.metrics.Retries, 1)
+		log.Println("Retrying", path, "after", wait, ":", err)
+		time.Sleep(wait)
+	}
+}
+
+// failureCode is the response code sent to a requester when dispatch failed with status
+func failureCode(status int) int {
+	if status >= 500 {
+		return status
+	}
+	return 500
+}
+
+// replyMetaKey holds a replyMeta in a service's reply to a proxy which asked for one with
+// Message.ReplyMeta. Other requesters get the handler's reply as it is. The format is
+// described in the README; a change to it needs a new replyMetaVersion.
+const replyMetaKey = "proxy_reply"
+
+// replyMetaVersion is the version of replyMeta this proxy writes and reads
+const replyMetaVersion = 1
+
+// replyMeta is how a responding proxy tells the requesting proxy about the dispatch
+type replyMeta struct {
+	Version  int `json:"version"`
+	Attempts int `json:"attempts"`
+}
+
+// withReplyMeta wraps data for the reply, if the requester reads replyMeta of version
+func withReplyMeta(version int, data interface{}, attempts int) interface{} {
+	if version < replyMetaVersion {
+		return data
+	}
+	return map[string]interface{}{"data": data, replyMetaKey: replyMeta{Version: replyMetaVersion, Attempts: attempts}}
+}
+
+// unwrapReplyMeta moves the responding proxy's replyMeta, if any, out of the data
+func (m *RequestResponseMessage) unwrapReplyMeta() {
+	wrapped, ok := m.Data.(map[string]interface{})
+	if !ok || len(wrapped) != 2 {
+		return
+	}
+	meta, ok := wrapped[replyMetaKey].(map[string]interface{})
+	if !ok || meta["version"] != float64(replyMetaVersion) {
+		return
+	}
+	if attempts, ok := meta["attempts"].(float64); ok {
+		m.Attempts = int(attempts)
+	}
+	m.Data = wrapped["data"]
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is returned when subscriptions are added to a node which is being drained
+var ErrDraining = errors.New("Node is draining")
+
+// ErrDrainTimeout is returned when dispatches are still running at the drain deadline
+var ErrDrainTimeout = errors.New("Timed out waiting for in-flight dispatches")
+
+// begin and end bracket every service request and slot signal being handled for the node
+func (node *Node) begin() {
+	atomic.AddInt64(&node.active, 1)
+}
+
+func (node *Node) end() {
+	atomic.AddInt64(&node.active, -1)
+}
+
+// InFlight returns the number of service requests and slot signals currently being handled
+func (node *Node) InFlight() int64 {
+	return atomic.LoadInt64(&node.active)
+}
+
+// IsDraining reports whether Drain has been called on the node
+func (node *Node) IsDraining() bool {
+	return atomic.LoadInt32(&node.draining) == 1
+}
+
+// Drain unsubscribes all of the node's services and slots, including buffered ones,
+// so no new work arrives, then waits up to timeout for in-flight dispatches to finish.
+// Signals still buffered are dead-lettered. It returns the number still in flight,
+// with ErrDrainTimeout if that is not zero.
+func (node *Node) Drain(timeout time.Duration) (int64, error) {
+	defer node.discardBuffers()
+	if atomic.CompareAndSwapInt32(&node.draining, 0, 1) {
+		log.Println("Draining node", node.id)
+		for _, service := range node.serviceList() {
+			node.engine.UnsubscribeReply(string(service.Topic), service.Subscription)
+		}
+		for _, slot := range node.slots {
+			node.engine.UnsubscribeSlot(slot.Topic, slot.Subscription)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := node.InFlight()
+		if inFlight == 0 {
+			return 0, nil
+		}
+		if time.Now().After(deadline) {
+			return inFlight, ErrDrainTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Shutdown drains every registered node in parallel within timeout, then stops their
+// engines so subscriptions and health idents are removed from the backend.
+// ErrDrainTimeout is returned if any node still had dispatches in flight.
+func Shutdown(timeout time.Duration) (err error) {
+	nodes := nMap.List()
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		go func(node *Node) {
+			inFlight, err := node.Drain(timeout)
+			if err != nil {
+				log.Println("Node", node.id, "still has", inFlight, "in flight:", err)
+			}
+			node.Stop()
+			errs <- err
+		}(node)
+	}
+	for range nodes {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return
+}
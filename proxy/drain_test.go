@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForInFlight(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node.begin()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		node.end()
+	}()
+	start := time.Now()
+	if inFlight, err := node.Drain(5 * time.Second); inFlight != 0 || err != nil {
+		t.Fatalf("drain = %d, %v", inFlight, err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("drain returned before the dispatch finished")
+	}
+	if !node.IsDraining() {
+		t.Fatal("node is not draining")
+	}
+	if err = node.AddService(Service{Topic: "sum", Group: "math", Path: "/sum"}); err != ErrDraining {
+		t.Fatalf("service added while draining: %v", err)
+	}
+}
+
+func TestDrainTimesOut(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node.begin()
+	defer node.end()
+	if inFlight, err := node.Drain(10 * time.Millisecond); inFlight != 1 || err != ErrDrainTimeout {
+		t.Fatalf("drain = %d, %v", inFlight, err)
+	}
+	// draining again keeps waiting for the same dispatch
+	if inFlight, err := node.Drain(0); inFlight != 1 || err != ErrDrainTimeout {
+		t.Fatalf("second drain = %d, %v", inFlight, err)
+	}
+}
+
+func TestShutdownDrainsEveryNode(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+	var nodes []*Node
+	for i := 0; i < 3; i++ {
+		node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	busy := nodes[0]
+	busy.begin()
+	if err := Shutdown(10 * time.Millisecond); err != ErrDrainTimeout {
+		t.Fatalf("shutdown with a dispatch in flight: %v", err)
+	}
+	for _, node := range nodes {
+		if !node.IsDraining() {
+			t.Errorf("node %s was not drained", node.id)
+		}
+	}
+	busy.end()
+	if err := Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// loopback hosts are always permitted, so sidecar nodes registered by port keep working
+var loopbackHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+var allowedHosts struct {
+	sync.RWMutex
+	patterns []string
+}
+
+// SetAllowedHosts configures the host patterns remote nodes may be registered on.
+// Patterns use shell glob syntax, e.g. "*.svc.cluster.local" or "10.0.1.*"
+func SetAllowedHosts(patterns []string) {
+	allowedHosts.Lock()
+	defer allowedHosts.Unlock()
+	allowedHosts.patterns = nil
+	for _, p := range patterns {
+		if p = strings.TrimSpace(p); p != "" {
+			allowedHosts.patterns = append(allowedHosts.patterns, strings.ToLower(p))
+		}
+	}
+}
+
+// HostAllowed reports whether a node may be registered on host
+func HostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range loopbackHosts {
+		if host == h {
+			return true
+		}
+	}
+	allowedHosts.RLock()
+	defer allowedHosts.RUnlock()
+	for _, p := range allowedHosts.patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var socketDir struct {
+	sync.RWMutex
+	dir string
+}
+
+// SetSocketDir configures the directory unix sockets of nodes must be in. With none,
+// nodes cannot be registered on a socket, so callers cannot make the proxy post to
+// sockets of other services on its host.
+func SetSocketDir(dir string) error {
+	if dir != "" {
+		var err error
+		if dir, err = resolveDir(dir); err != nil {
+			return err
+		}
+	}
+	socketDir.Lock()
+	defer socketDir.Unlock()
+	socketDir.dir = dir
+	return nil
+}
+
+// SocketAllowed reports whether a node may be registered on the unix socket at p.
+// The socket must exist. Symlinks are followed, so a link in the socket directory cannot
+// point outside it.
+func SocketAllowed(p string) bool {
+	_, ok := resolveSocket(p)
+	return ok
+}
+
+// resolveSocket returns the path of the socket at p with symlinks resolved, if it is allowed
+func resolveSocket(p string) (string, bool) {
+	socketDir.RLock()
+	defer socketDir.RUnlock()
+	// The node is already listening when it registers, so the socket exists
+	return resolveInDir(socketDir.dir, p)
+}
+
+// resolveDir returns the absolute path of dir with symlinks resolved
+func resolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// inDir reports whether the existing file p is inside dir, a directory from resolveDir.
+// Symlinks are followed. It is false when dir is empty.
+func inDir(dir string, p string) bool {
+	_, ok := resolveInDir(dir, p)
+	return ok
+}
+
+// resolveInDir returns p with symlinks resolved, and whether that is inside dir
+func resolveInDir(dir string, p string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	return resolved, err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func validateURL(errs *ValidationErrors, field string, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		errs.add(field, "must be a valid url")
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		errs.add(field, "scheme must be http or https")
+		return
+	}
+	if u.Hostname() == "" {
+		errs.add(field, "host required")
+		return
+	}
+	// handler paths are appended to the url, and it is shown in the node's details
+	if u.User != nil {
+		errs.add(field, "cannot contain credentials")
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		errs.add(field, "cannot have a query")
+	}
+	if u.Fragment != "" {
+		errs.add(field, "cannot have a fragment")
+	}
+	if !HostAllowed(u.Hostname()) {
+		errs.add(field, "host "+u.Hostname()+" is not allowed")
+	}
+}
+
+// baseURL returns the address node handlers are reached on
+func (nodeReq *NodeReq) baseURL() string {
+	if nodeReq.Socket != "" {
+		return "http://" + socketHost
+	}
+	if nodeReq.URL != "" {
+		return strings.TrimRight(nodeReq.URL, "/")
+	}
+	scheme := "http://"
+	if nodeReq.TLS != nil {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort("127.0.0.1", string(nodeReq.Port))
+}
+
+// endpoint joins a handler or health check path onto the node's base URL
+func (node *Node) endpoint(p string) string {
+	return node.baseURL + "/" + strings.TrimLeft(p, "/")
+}
+
+// GetURL returns the base URL node handlers are reached on
+func (node *Node) GetURL() string {
+	return node.baseURL
+}
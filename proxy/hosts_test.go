@@ -0,0 +1,57 @@
+package proxy
+
+import "testing"
+
+func TestHostAllowed(t *testing.T) {
+	SetAllowedHosts([]string{" *.svc.cluster.local", "10.0.1.*", ""})
+	defer SetAllowedHosts(nil)
+	for _, tc := range []struct {
+		host    string
+		allowed bool
+	}{
+		{"localhost", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"worker.svc.cluster.local", true},
+		{"WORKER.SVC.Cluster.Local", true},
+		{"10.0.1.7", true},
+		{"10.0.2.7", false},
+		{"svc.cluster.local", false},
+		{"evil.com", false},
+		{"", false},
+	} {
+		if allowed := HostAllowed(tc.host); allowed != tc.allowed {
+			t.Errorf("HostAllowed(%q) = %v", tc.host, allowed)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	SetAllowedHosts([]string{"*.svc.cluster.local"})
+	defer SetAllowedHosts(nil)
+	for _, tc := range []struct {
+		url   string
+		valid bool
+	}{
+		{"http://localhost:9000", true},
+		{"https://worker.svc.cluster.local/api/", true},
+		{"http://127.0.0.1:9000/api", true},
+		{"ftp://localhost", false},
+		{"localhost:9000", false},
+		{"http:///api", false},
+		{"http://evil.com/api", false},
+		{"https://user:pw@worker.svc.cluster.local", false},
+		{"https://user@worker.svc.cluster.local", false},
+		{"https://worker.svc.cluster.local/?x=1", false},
+		{"https://worker.svc.cluster.local/?", false},
+		{"https://worker.svc.cluster.local/#y", false},
+		{"https://user:pw@worker.svc.cluster.local/?x#y", false},
+		{"http://local host", false},
+	} {
+		errs := ValidationErrors{}
+		validateURL(&errs, "url", tc.url)
+		if valid := len(errs) == 0; valid != tc.valid {
+			t.Errorf("validateURL(%q): %v", tc.url, errs)
+		}
+	}
+}
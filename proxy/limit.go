@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// BusyCode is the response code sent to a requester when a service's queue is full
+const BusyCode = 429
+
+// ErrBusy is returned when a handler is at max_concurrency and its queue is full
+var ErrBusy = errors.New("busy")
+
+// limiter bounds concurrent dispatches to a single service or slot handler.
+// Calls beyond maxConcurrency wait in a queue of at most maxQueue.
+type limiter struct {
+	sync.Mutex
+	sem      chan struct{}
+	waiting  int
+	maxQueue int
+}
+
+// newLimiter returns nil (no limit) when maxConcurrency is 0
+func newLimiter(maxConcurrency int, maxQueue int) *limiter {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	return &limiter{sem: make(chan struct{}, maxConcurrency), maxQueue: maxQueue}
+}
+
+// acquire takes a slot, waiting in the queue if needed. It returns ErrBusy when the queue
+// is full, or when ctx is done before a slot is free.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.Lock()
+	if l.waiting >= l.maxQueue {
+		l.Unlock()
+		return ErrBusy
+	}
+	l.waiting++
+	l.Unlock()
+
+	defer func() {
+		l.Lock()
+		l.waiting--
+		l.Unlock()
+	}()
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ErrBusy
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
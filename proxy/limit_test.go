@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func (l *limiter) queued() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.waiting
+}
+
+func TestLimiterQueues(t *testing.T) {
+	l := newLimiter(1, 1)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.acquire(context.Background())
+	}()
+	for l.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.acquire(context.Background()); err != ErrBusy {
+		t.Fatalf("acquire with a full queue = %v", err)
+	}
+	l.release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("queued acquire = %v", err)
+	}
+	l.release()
+	if l.queued() != 0 {
+		t.Fatalf("waiting = %d", l.queued())
+	}
+}
+
+func TestLimiterQueueTimesOut(t *testing.T) {
+	l := newLimiter(1, 1)
+	l.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.acquire(ctx); err != ErrBusy {
+		t.Fatalf("acquire behind a hung call = %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("waited %s", waited)
+	}
+	if l.queued() != 0 {
+		t.Fatalf("waiting after the timeout = %d", l.queued())
+	}
+	l.release()
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoLimiter(t *testing.T) {
+	l := newLimiter(0, 10)
+	if l != nil {
+		t.Fatal("limiter without max_concurrency")
+	}
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.release()
+}
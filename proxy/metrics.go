@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// NodeMetrics counts dispatch and connection activity for a node
+type NodeMetrics struct {
+	Dispatches  int64 `json:"dispatches"`
+	Failures    int64 `json:"failures"`
+	InFlight    int64 `json:"in_flight"`
+	ConnsOpened int64 `json:"conns_opened"`
+	ConnsReused int64 `json:"conns_reused"`
+	Rejected    int64 `json:"rejected"`
+	Retries     int64 `json:"retries"`
+	Tripped     int64 `json:"short_circuited"`
+	Denied      int64 `json:"denied"`
+	RateLimited int64 `json:"rate_limited"`
+}
+
+func (m *NodeMetrics) connOpened() {
+	atomic.AddInt64(&m.ConnsOpened, 1)
+}
+
+func (m *NodeMetrics) rejected() {
+	atomic.AddInt64(&m.Rejected, 1)
+}
+
+// trace records whether each dispatch got a pooled connection
+func (m *NodeMetrics) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&m.ConnsReused, 1)
+			}
+		},
+	}
+}
+
+// Snapshot returns a consistent copy that is safe to serialise
+func (m *NodeMetrics) Snapshot() NodeMetrics {
+	return NodeMetrics{
+		Dispatches:  atomic.LoadInt64(&m.Dispatches),
+		Failures:    atomic.LoadInt64(&m.Failures),
+		InFlight:    atomic.LoadInt64(&m.InFlight),
+		ConnsOpened: atomic.LoadInt64(&m.ConnsOpened),
+		ConnsReused: atomic.LoadInt64(&m.ConnsReused),
+		Rejected:    atomic.LoadInt64(&m.Rejected),
+		Retries:     atomic.LoadInt64(&m.Retries),
+		Tripped:     atomic.LoadInt64(&m.Tripped),
+		Denied:      atomic.LoadInt64(&m.Denied),
+		RateLimited: atomic.LoadInt64(&m.RateLimited),
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Actions a policy rule can apply to
+const (
+	ActionSubscribe = "subscribe"
+	ActionPublish   = "publish"
+)
+
+// PolicyDeniedCode is the response code sent to a requester whose publish was denied
+const PolicyDeniedCode = 403
+
+// PolicyRule allows or denies topics to the nodes it selects. A rule selects a node when
+// the node's owner is one of Principals (or Principals is empty) and the node has every
+// label in Labels.
+type PolicyRule struct {
+	Effect     string            `json:"effect"`  // "allow" or "deny"
+	Actions    []string          `json:"actions"` // "subscribe", "publish", or empty for both
+	Topics     []string          `json:"topics"`  // topic patterns, * matches any run of characters
+	Principals []string          `json:"principals"`
+	Labels     map[string]string `json:"labels"`
+
+	patterns []*regexp.Regexp
+}
+
+// Policy holds the topic rules. A deny rule always wins over an allow rule. Topics no rule
+// matches are allowed unless Default is "deny".
+type Policy struct {
+	Default string       `json:"default"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyDenied is the error returned for a denied subscription or publish
+type PolicyDenied struct {
+	Action string
+	Topic  string
+}
+
+func (e PolicyDenied) Error() string {
+	return fmt.Sprintf("Not allowed to %s to %s", e.Action, e.Topic)
+}
+
+var policy struct {
+	sync.RWMutex
+	*Policy
+}
+
+// LoadPolicy reads a JSON policy file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err = p.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return p, nil
+}
+
+// SetPolicy replaces the topic policy. A nil policy allows everything.
+func SetPolicy(p *Policy) error {
+	if p != nil {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	policy.Lock()
+	defer policy.Unlock()
+	policy.Policy = p
+	return nil
+}
+
+func (p *Policy) compile() error {
+	switch p.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return fmt.Errorf("rules[%d].effect must be allow or deny, not %q", i, rule.Effect)
+		}
+		for _, action := range rule.Actions {
+			if action != ActionSubscribe && action != ActionPublish {
+				return fmt.Errorf("rules[%d].actions: unknown action %q", i, action)
+			}
+		}
+		rule.patterns = rule.patterns[:0]
+		for _, topic := range rule.Topics {
+			rule.patterns = append(rule.patterns, topicPattern(topic))
+		}
+	}
+	return nil
+}
+
+// topicPattern compiles a Gilmour topic pattern, where * matches any run of characters
+func topicPattern(topic string) *regexp.Regexp {
+	parts := strings.Split(topic, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func (rule *PolicyRule) selects(node *Node, action string) bool {
+	if len(rule.Actions) > 0 && !stringIn(action, rule.Actions) {
+		return false
+	}
+	if len(rule.Principals) > 0 && !stringIn(node.owner, rule.Principals) {
+		return false
+	}
+	for k, v := range rule.Labels {
+		if node.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether every topic matched by topic is matched by the rule
+func (rule *PolicyRule) covers(topic string) bool {
+	for _, pattern := range rule.patterns {
+		if pattern.MatchString(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether topic, which may itself be a wildcard, can match any topic the rule
+// matches, so that wildcard subscriptions cannot reach denied topics
+func (rule *PolicyRule) overlaps(topic string) bool {
+	for _, t := range rule.Topics {
+		if globsIntersect(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// globsIntersect reports whether some topic matches both patterns, where * matches any run
+// of characters
+func globsIntersect(a, b string) bool {
+	seen := make(map[[2]int]bool)
+	var intersect func(i, j int) bool
+	intersect = func(i, j int) bool {
+		key := [2]int{i, j}
+		if done, ok := seen[key]; ok {
+			return done
+		}
+		result := false
+		switch {
+		case i == len(a) && j == len(b):
+			result = true
+		case i < len(a) && a[i] == '*':
+			// the star matches nothing, or takes the next character of b
+			result = intersect(i+1, j) || (j < len(b) && intersect(i, j+1))
+		case j < len(b) && b[j] == '*':
+			result = intersect(i, j+1) || (i < len(a) && intersect(i+1, j))
+		case i < len(a) && j < len(b):
+			result = a[i] == b[j] && intersect(i+1, j+1)
+		}
+		seen[key] = result
+		return result
+	}
+	return intersect(0, 0)
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allows evaluates the policy for one subscription or publish by node
+func (p *Policy) allows(node *Node, action string, topic string) bool {
+	allowed := p.Default != "deny"
+	matched := false
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.selects(node, action) {
+			continue
+		}
+		if rule.Effect == "deny" && rule.overlaps(topic) {
+			return false
+		}
+		if rule.Effect == "allow" && rule.covers(topic) {
+			matched = true
+		}
+	}
+	return allowed || matched
+}
+
+// authorizeTopic returns PolicyDenied if the policy does not let the node use topic.
+// Denials are logged and counted in the node's metrics.
+func (node *Node) authorizeTopic(action string, topic string) error {
+	policy.RLock()
+	p := policy.Policy
+	policy.RUnlock()
+	if p == nil || p.allows(node, action, topic) {
+		return nil
+	}
+	atomic.AddInt64(&node.metrics.Denied, 1)
+	log.Printf("Policy denied node %s (owner %q) to %s to %s", node.id, node.owner, action, topic)
+	return PolicyDenied{Action: action, Topic: topic}
+}
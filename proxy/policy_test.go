@@ -0,0 +1,88 @@
+package proxy
+
+import "testing"
+
+func TestGlobsIntersect(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"secret.*.c", "secret.b.c", true},
+		{"secret.*.c", "*.b.c", true},
+		{"secret.*.c", "secret.b*", true},
+		{"secret.*.c", "*", true},
+		{"secret.*.c", "public.*", false},
+		{"secret.*.c", "*.d", false},
+		{"billing.admin.*", "billing.*", true},
+		{"a*b", "*c", false},
+		{"a*", "*a", true},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+	}
+	for _, c := range cases {
+		if got := globsIntersect(c.a, c.b); got != c.want {
+			t.Errorf("globsIntersect(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+		if got := globsIntersect(c.b, c.a); got != c.want {
+			t.Errorf("globsIntersect(%q, %q) = %v, want %v", c.b, c.a, got, c.want)
+		}
+	}
+}
+
+func TestPolicyDeniesWildcardsReachingDeniedTopics(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{{Effect: "deny", Topics: []string{"secret.*.c"}}}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{}
+	for _, topic := range []string{"secret.b.c", "*.b.c", "secret.b*", "*"} {
+		if p.allows(node, ActionSubscribe, topic) {
+			t.Errorf("subscription to %q allowed, but it can receive secret.b.c", topic)
+		}
+	}
+	for _, topic := range []string{"public.b.c", "secret.b.d", "*.d"} {
+		if !p.allows(node, ActionSubscribe, topic) {
+			t.Errorf("subscription to %q denied", topic)
+		}
+	}
+}
+
+func TestPolicyAllowCoversWildcards(t *testing.T) {
+	p := &Policy{Default: "deny", Rules: []PolicyRule{{Effect: "allow", Topics: []string{"orders.*"}}}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{}
+	if !p.allows(node, ActionSubscribe, "orders.*.created") {
+		t.Error("orders.*.created should be allowed by orders.*")
+	}
+	if p.allows(node, ActionSubscribe, "*.created") {
+		t.Error("*.created is not covered by orders.*")
+	}
+}
+
+func TestNodeLabelsComeFromTheCredential(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{{Effect: "deny", Topics: []string{"billing.*"}, Labels: map[string]string{"team": "web"}}}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{}
+	if err := node.BindCredential(&Credential{Principal: "web", Labels: map[string]string{"team": "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	if p.allows(node, ActionSubscribe, "billing.charge") {
+		t.Error("node of a team=web credential escaped the label-scoped deny rule")
+	}
+
+	node = &Node{labels: map[string]string{"team": "billing"}}
+	if err := node.BindCredential(&Credential{Principal: "web"}); err == nil {
+		t.Error("a non-admin credential could choose the node's labels")
+	}
+	node = &Node{labels: map[string]string{"team": "billing"}}
+	if err := node.BindCredential(&Credential{Principal: "ops", Admin: true}); err != nil {
+		t.Errorf("admin could not label the node: %s", err)
+	}
+	if node.labels["team"] != "billing" {
+		t.Errorf("labels = %v", node.labels)
+	}
+}
@@ -1,11 +1,9 @@
 package proxy
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
@@ -73,6 +71,16 @@ func (n *nodeMap) Del(uid NodeID) (err error) {
 	return
 }
 
+// List returns every registered node
+func (n *nodeMap) List() (nodes []*Node) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	for _, node := range n.regNodes {
+		nodes = append(nodes, node)
+	}
+	return
+}
+
 // Get returns node from nodeMap
 func (n *nodeMap) Get(uid NodeID) (node *Node, err error) {
 	n.Mutex.Lock()
@@ -88,28 +96,41 @@ func (n *nodeMap) Get(uid NodeID) (node *Node, err error) {
 
 // Request is a struct for managing requests coming from node
 type Request struct {
-	Topic       string      `json:"topic"`
-	Composition interface{} `json:"composition"`
-	Message     interface{} `json:"message"`
-	Timeout     int         `json:"timeout"`
+	Topic       string       `json:"topic"`
+	Composition *Composition `json:"composition,omitempty"`
+	Message     interface{}  `json:"message"`
+	Timeout     int          `json:"timeout"`
+	Async       bool         `json:"async,omitempty"`
+	Callback    string       `json:"callback,omitempty"`
+}
+
+// Topics returns the topics the request is sent to: its Topic, or those of its Composition
+func (r *Request) Topics() []string {
+	if r.Composition != nil {
+		return r.Composition.topics()
+	}
+	return []string{r.Topic}
 }
 
 // RequestResponse is a struct for responding to a Request
 type RequestResponse struct {
-	Messages interface{} `json:"messages"`
-	Code     int         `json:"code"`
-	Length   int         `json:"length"`
+	Messages []RequestResponseMessage `json:"messages"`
+	Code     int                      `json:"code"`
+	Length   int                      `json:"length"`
 }
 
 type RequestResponseMessage struct {
-	Data interface{} `json:"data"`
-	Code int         `json:"code"`
+	Data     interface{} `json:"data"`
+	Code     int         `json:"code"`
+	Attempts int         `json:"attempts,omitempty"` // calls the responding proxy made to its node's handler
 }
 
 // Message is a struct which has data to be processed and handler path for node
 type Message struct {
 	Data        interface{} `json:"data"`
 	HandlerPath string      `json:"handler_path"`
+	Attempt     int         `json:"attempt,omitempty"`
+	ReplyMeta   int         `json:"reply_meta,omitempty"` // the replyMeta version the requesting proxy reads, 0 for none
 }
 
 type GilmourTopic string
@@ -117,53 +138,101 @@ type GilmourTopic string
 // NodeID is a string to hold node's id
 type NodeID string
 
-// ServiceMap is a type of GilmourTopic to string
-type ServiceMap map[GilmourTopic]Service
-
 //Node structure
 type NodeReq struct {
-	Port            string     `json:"port"`
-	HealthCheckPath string     `json:"health_check"`
-	Slots           []Slot     `json:"slots"`
-	Services        ServiceMap `json:"services"`
+	Port            PortValue         `json:"port"`
+	URL             string            `json:"url"`
+	Socket          string            `json:"socket"`
+	HealthCheckPath string            `json:"health_check"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	TLS             *NodeTLS          `json:"tls,omitempty"`
+	Slots           []Slot            `json:"slots"`
+	Services        ServiceList       `json:"services"`
+	NodeRateLimits
+
+	socketPath string // Socket with symlinks resolved when it was validated
 }
 
 type NodeDetailsReq struct {
-	Identifier		NodeID		`json:"id"`
-	Port            string     	`json:"port"`
-	HealthCheckPath string     	`json:"health_check"`
-	Slots           []Slot     	`json:"slots"`
-	Services        ServiceMap 	`json:"services"`
-	Status 			string 		`json:"status"`
+	Identifier      NodeID            `json:"id"`
+	Port            string            `json:"port"`
+	URL             string            `json:"url"`
+	Socket          string            `json:"socket"`
+	HealthCheckPath string            `json:"health_check"`
+	Slots           []Slot            `json:"slots"`
+	Services        ServiceList       `json:"services"`
+	Status          string            `json:"status"`
+	Draining        bool              `json:"draining"`
+	InFlight        int64             `json:"in_flight"`
+	Metrics         NodeMetrics       `json:"metrics"`
+	Owner           string            `json:"owner,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	TLS             *NodeTLS          `json:"tls,omitempty"`
+	BodyLimits      BodyLimits        `json:"body_limits"`
+	Transport       string            `json:"transport"`
+	NodeRateLimits
 }
 
 type Node struct {
 	port            string
+	baseURL         string
+	socket          string
+	client          *http.Client
+	healthClient    *http.Client
+	metrics         *NodeMetrics
+	breakersMu      sync.Mutex
+	breakers        map[string]*breaker
+	buffersMu       sync.Mutex
+	buffers         map[string]*signalBuffer
+	active          int64
+	done            chan struct{}
+	stopOnce        sync.Once
+	draining        int32
 	healthcheckpath string
 	slots           []Slot
-	services        ServiceMap
+	servicesMu      sync.RWMutex // services is replaced, never changed in place
+	services        ServiceList
 	status          Status
 	engine          *G.Gilmour
 	id              NodeID
+	owner           string
+	labels          map[string]string
+	tls             *NodeTLS
+	secret          string
+	rateLimits      nodeLimiters
+	bodyLimits      BodyLimits
+	async           asyncRequests
+	channel         *nodeChannel
 }
 
 // Service is a struct which holds details for the service to be added / removed
 type Service struct {
-	Group        string          `json:"group"`
-	Path         string          `json:"path"`
-	Timeout      int             `json:"timeout"`
-	Data         interface{}     `json:"data"`
-	Subscription *G.Subscription `json:"subscription"`
+	Topic          GilmourTopic    `json:"topic"`
+	Group          string          `json:"group"`
+	Path           string          `json:"path"`
+	Timeout        int             `json:"timeout"`
+	MaxConcurrency int             `json:"max_concurrency"`
+	MaxQueue       int             `json:"max_queue"`
+	Retry          *RetryPolicy    `json:"retry,omitempty"`
+	Circuit        string          `json:"circuit,omitempty"`
+	Data           interface{}     `json:"data"`
+	Subscription   *G.Subscription `json:"subscription"`
 }
 
 // Slot is a struct which holds details for the slot to be added / removed
 type Slot struct {
-	Topic        string          `json:"topic"`
-	Group        string          `json:"group"`
-	Path         string          `json:"path"`
-	Timeout      int             `json:"timeout"`
-	Data         interface{}     `json:"data"`
-	Subscription *G.Subscription `json:"subscription"`
+	Topic          string          `json:"topic"`
+	Group          string          `json:"group"`
+	Path           string          `json:"path"`
+	Timeout        int             `json:"timeout"`
+	MaxConcurrency int             `json:"max_concurrency"`
+	MaxQueue       int             `json:"max_queue"`
+	Retry          *RetryPolicy    `json:"retry,omitempty"`
+	Buffer         *BufferPolicy   `json:"buffer,omitempty"`
+	Buffered       int             `json:"buffered,omitempty"`
+	Circuit        string          `json:"circuit,omitempty"`
+	Data           interface{}     `json:"data"`
+	Subscription   *G.Subscription `json:"subscription"`
 }
 
 // Providing NodeOperations
@@ -175,12 +244,11 @@ type NodeOperations interface {
 	GetEngine() *G.Gilmour
 	GetNodeDetails(id string) (NodeDetailsReq, error)
 	GetStatus(sync bool) (int, error)
-	GetServices() (ServiceMap, error)
+	GetServices() (ServiceList, error)
 
-	AddService(GilmourTopic, Service) error
-	AddServices(ServiceMap) (err error)
-	RemoveService(GilmourTopic, Service) error
-	RemoveServices(ServiceMap) error
+	AddService(Service) error
+	AddServices(ServiceList) (err error)
+	RemoveServices(topic GilmourTopic, path string) ([]Service, error)
 
 	RequestService(Request) RequestResponse
 	Start() error
@@ -210,36 +278,95 @@ func (node *Node) GetEngine() *G.Gilmour {
 }
 
 // GetServices returns all the services which node is currently subscribed to
-func (node *Node) GetServices() (services ServiceMap, err error) {
+func (node *Node) GetServices() (services ServiceList, err error) {
 	if node.status == 200 {
-		services = node.services
+		for _, service := range node.serviceList() {
+			service.Circuit = node.breaker(service.Path).State()
+			services = append(services, service)
+		}
 	}
 	return
 }
 
 // Stop Exit routine. UnSubscribes Slots, removes registered health ident and triggers backend Stop
 func (node *Node) Stop() (err error) {
+	if node.channel != nil {
+		node.channel.close()
+	}
 	node.engine.Stop()
 	return
 }
 
-func DeleteNode(node *Node) error {
-	if _, err := http.Get("http://127.0.0.1:" + node.port); err != nil {
+// DeleteReport describes what DeleteNode cleaned up
+type DeleteReport struct {
+	ID        NodeID         `json:"id"`
+	Status    string         `json:"status"`
+	Reachable bool           `json:"reachable"`
+	Services  []GilmourTopic `json:"services"`
+	Slots     []string       `json:"slots"`
+	InFlight  int64          `json:"in_flight"`
+}
+
+// DeleteNode always removes the node, whether or not its process is still running.
+// Its services and slots are unsubscribed, its watchdog is cancelled, its engine stopped
+// and its pooled connections closed, and its dead letters purged. Unless force is set, it first waits up to timeout
+// for in-flight dispatches to finish, and reports those which did not.
+func DeleteNode(node *Node, force bool, timeout time.Duration) (report DeleteReport) {
+	report.ID = node.id
+	report.Status = "ok"
+	report.Reachable = node.reachable()
+
+	for _, service := range node.serviceList() {
+		report.Services = append(report.Services, service.Topic)
+	}
+	for _, slot := range node.slots {
+		report.Slots = append(report.Slots, slot.Topic)
+	}
+	if force {
+		timeout = 0
+	}
+	var err error
+	if report.InFlight, err = node.Drain(timeout); err != nil && !force {
 		log.Println(err)
-		return err
+		report.Status = err.Error()
 	}
 
 	if err := nMap.Del(node.id); err != nil {
 		log.Println(err)
-		return err
 	}
-
+	node.cancelWatchdog()
 	if err := node.Stop(); err != nil {
 		log.Println(err)
-		return err
 	}
+	if node.client != nil {
+		node.client.CloseIdleConnections()
+	}
+	// the node's id is not used again, so nothing could reach its dead letters
+	if err := node.PurgeDeadLetters(nil); err != nil && err != ErrNoDeadLetterStore {
+		log.Println(err)
+	}
+	return
+}
 
-	return nil
+// reachable reports whether the node's process answers at all
+func (node *Node) reachable() bool {
+	if node.channel != nil {
+		return node.channel.current() != nil
+	}
+	resp, err := node.healthClient.Get(node.baseURL)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// cancelWatchdog stops the node's NodeWatchdog, if one is running
+func (node *Node) cancelWatchdog() {
+	node.stopOnce.Do(func() {
+		close(node.done)
+	})
 }
 
 //******************************************************************************
@@ -249,6 +376,7 @@ type CreateNodeResponse struct {
 	ID          string `json:"id"`
 	PublishPort string `json:"publish_port"`
 	Status      int    `json:"status"`
+	Secret      string `json:"secret"`
 }
 
 ///////////////////////////////////////////////////////////////////////
@@ -267,101 +395,155 @@ func uniqueNodeID(strlen int) (id string) {
 func (node *Node) FormatResponse() (resp CreateNodeResponse) {
 	resp.ID = string(node.id)
 	resp.PublishPort = node.port
-	resp.Status, _ = fmt.Printf("%v", node.status)
+	resp.Status = int(node.status)
+	resp.Secret = node.secret
 	return
 }
 
 /////////////////////////////////////////////////////////////////////////////////////
 // Bind the function with the services
 
-func (service Service) bindListeners(listenPort string, healthPath string) func(req *G.Request, resp *G.Message) {
+func (service Service) bindListeners(node *Node) func(req *G.Request, resp *G.Message) {
+	limit := newLimiter(service.MaxConcurrency, service.MaxQueue)
 	return func(req *G.Request, resp *G.Message) {
+		node.begin()
+		defer node.end()
 		message := new(Message)
 		if err := req.Data(message); err != nil {
 			log.Println(err.Error())
 			return
 		}
-		mJSON, err := json.Marshal(message)
-		fmt.Println("Received : ", message, string(mJSON))
-		if err != nil {
-			log.Println(err.Error())
+		fmt.Println("Received : ", message)
+		if err := node.allowDispatch(service.Path); err != nil {
+			resp.SetData(map[string]string{"error": err.Error()}).SetCode(BusyCode)
 			return
 		}
-		requester := fmt.Sprintf("http://localhost:%s/%s", listenPort, service.Path)
-		log.Println(requester)
-		hndlrResp, err := http.Post(requester, "application/json", bytes.NewBuffer(mJSON))
-		body, err := ioutil.ReadAll(hndlrResp.Body)
-		if err != nil {
-			log.Println(err)
+		// a call waits in the queue no longer than it could wait for its handler
+		queued, cancel := context.WithTimeout(context.Background(), dispatchTimeout(service.Timeout))
+		defer cancel()
+		if err := limit.acquire(queued); err != nil {
+			node.metrics.rejected()
+			log.Println(service.Path, err)
+			resp.SetData(map[string]string{"error": err.Error()}).SetCode(BusyCode)
 			return
 		}
-		var data interface{}
-		log.Println("Request: ", requester, "Response", hndlrResp)
-		err = json.Unmarshal(body, &data)
+		defer limit.release()
+		version := message.ReplyMeta
+		message.ReplyMeta = 0
+		data, status, attempts, err := node.dispatchWithRetry(service.Path, message, service.Retry, service.Timeout)
 		if err != nil {
-			log.Println("Json Error: ", err.Error())
+			log.Println(err)
+			resp.SetData(withReplyMeta(version, map[string]interface{}{"error": err.Error(), "attempts": attempts}, attempts)).SetCode(failureCode(status))
 			return
 		}
-		resp.SetData(data)
+		resp.SetData(withReplyMeta(version, data, attempts))
 	}
 }
 
 //Bind the function with the slots
-func (slot Slot) bindListeners(listenPort string, healthPath string) func(req *G.Request) {
+func (slot Slot) bindListeners(node *Node) func(req *G.Request) {
+	limit := newLimiter(slot.MaxConcurrency, slot.MaxQueue)
 	return func(req *G.Request) {
+		node.begin()
+		defer node.end()
 		message := new(Message)
 		if err := req.Data(message); err != nil {
 			log.Println(err.Error())
 			return
 		}
 		fmt.Println("Received: ", message.Data)
-		mJSON, err := json.Marshal(message)
-		if err != nil {
-			log.Println(err.Error())
+		if slot.Buffer != nil && node.buffer(slot).hold(node, slot, message) {
 			return
 		}
-		requester := fmt.Sprintf("http://localhost:%s/%s", listenPort, slot.Path)
-		log.Println(requester)
-		hndlrResp, err := http.Post(requester, "application/json", bytes.NewBuffer(mJSON))
-		body, err := ioutil.ReadAll(hndlrResp.Body)
-		if err != nil {
-			log.Println(err)
+		if err := node.allowDispatch(slot.Path); err != nil {
+			node.deadLetter(slot, message, err)
 			return
 		}
-		var data interface{}
-		log.Println("Request: ", requester, "Response", hndlrResp)
-		err = json.Unmarshal(body, &data)
-		if err != nil {
-			log.Println("Json Error: ", err.Error())
+		// a call waits in the queue no longer than it could wait for its handler
+		queued, cancel := context.WithTimeout(context.Background(), dispatchTimeout(slot.Timeout))
+		defer cancel()
+		if err := limit.acquire(queued); err != nil {
+			node.metrics.rejected()
+			log.Println(slot.Topic, slot.Path, err)
+			node.deadLetter(slot, message, err)
 			return
 		}
+		defer limit.release()
+		node.deliverSignal(slot, bufferedSignal{message: message, received: time.Now()})
 	}
 }
 
+// deliverSignal dispatches a slot signal, dead-lettering it if every attempt fails.
+// For a buffered slot, a signal the node did not answer or answered with a 5xx code
+// is queued again instead, and true is returned.
+func (node *Node) deliverSignal(slot Slot, signal bufferedSignal) (requeued bool) {
+	_, status, attempts, err := node.dispatchWithRetry(slot.Path, signal.message, slot.Retry, slot.Timeout)
+	if err == nil {
+		return false
+	}
+	log.Println(err, "after", attempts, "attempts")
+	if slot.Buffer != nil && (status == 0 || status >= 500) && node.buffer(slot).requeue(node, slot, signal) {
+		return true
+	}
+	node.deadLetter(slot, signal.message, err)
+	return false
+}
+
 // GetSlots returns all the slots on which node is currently subscribed to
 func (node *Node) GetSlots() (slots []Slot, err error) {
 	if node.status == 200 {
-		slots = node.slots
+		for _, slot := range node.slots {
+			slot.Circuit = node.breaker(slot.Path).State()
+			if slot.Buffer != nil {
+				slot.Buffered = node.buffer(slot).Len()
+			}
+			slots = append(slots, slot)
+		}
 	}
 	return
 }
 
-// AddService adds and subscribes a service in the existing list of services
-func (node *Node) AddService(topic GilmourTopic, service Service) (err error) {
+// AddService adds and subscribes a service in the existing list of services.
+// Re-adding a service with the same topic, group and path replaces its subscription
+func (node *Node) AddService(service Service) (err error) {
+	if err = ValidateService(service); err != nil {
+		return
+	}
+	if node.IsDraining() {
+		return ErrDraining
+	}
+	if err = node.authorizeTopic(ActionSubscribe, string(service.Topic)); err != nil {
+		return
+	}
 	o := G.NewHandlerOpts()
 	o.SetTimeout(service.Timeout)
 	o.SetGroup(service.Group)
-	if service.Subscription, err = node.engine.ReplyTo(string(topic), service.bindListeners(node.port, node.healthcheckpath), o); err != nil {
+	if service.Subscription, err = node.engine.ReplyTo(string(service.Topic), service.bindListeners(node), o); err != nil {
 		return
 	}
-	node.services[topic] = service
+	node.servicesMu.Lock()
+	defer node.servicesMu.Unlock()
+	services := append(ServiceList(nil), node.services...)
+	if i := serviceIndex(services, service); i != -1 {
+		services[i].Subscription = service.Subscription
+	} else {
+		services = append(services, service)
+	}
+	node.services = services
 	return
 }
 
+// serviceList returns the node's services. The list must not be changed.
+func (node *Node) serviceList() ServiceList {
+	node.servicesMu.RLock()
+	defer node.servicesMu.RUnlock()
+	return node.services
+}
+
 // AddServices adds multiple service's to the existing list of service's by subscribe them
-func (node *Node) AddServices(services ServiceMap) (err error) {
-	for topic, service := range services {
-		if err = node.AddService(topic, service); err != nil {
+func (node *Node) AddServices(services ServiceList) (err error) {
+	for _, service := range services {
+		if err = node.AddService(service); err != nil {
 			log.Println(err)
 			return
 		}
@@ -380,18 +562,21 @@ func contains(slots []Slot, slotToAdd Slot) (bool, int) {
 	return false, -1
 }
 
-func (node *Node) RemoveService(topic GilmourTopic, service Service) (err error) {
-	node.engine.UnsubscribeReply(string(topic), service.Subscription)
-	delete(node.services, topic)
-	return
-}
-
 // AddSlot adds and subscribes a slot in the existing list of slots
 func (node *Node) AddSlot(slot Slot) (err error) {
+	if err = ValidateSlot(slot); err != nil {
+		return
+	}
+	if node.IsDraining() {
+		return ErrDraining
+	}
+	if err = node.authorizeTopic(ActionSubscribe, slot.Topic); err != nil {
+		return
+	}
 	o := G.NewHandlerOpts()
 	o.SetTimeout(slot.Timeout)
 	o.SetGroup(slot.Group)
-	if slot.Subscription, err = node.engine.Slot(slot.Topic, slot.bindListeners(node.port, node.healthcheckpath), o); err != nil {
+	if slot.Subscription, err = node.engine.Slot(slot.Topic, slot.bindListeners(node), o); err != nil {
 		return
 	}
 	slotExists, pos := contains(node.slots, slot)
@@ -461,7 +646,7 @@ func (node *Node) Start() error {
 		return errors.New("Please setup backend engine")
 	}
 	node.engine.Start()
-	if err := node.AddServices(node.services); err != nil {
+	if err := node.AddServices(node.serviceList()); err != nil {
 		return err
 	}
 	if err := node.AddSlots(node.slots); err != nil {
@@ -470,13 +655,53 @@ func (node *Node) Start() error {
 	return nil
 }
 
+// suspend removes the node's subscriptions while it is unavailable.
+// Buffered slots stay subscribed and queue their signals instead
+func (node *Node) suspend() {
+	for _, service := range node.serviceList() {
+		node.engine.UnsubscribeReply(string(service.Topic), service.Subscription)
+	}
+	for _, slot := range node.slots {
+		if slot.Buffer == nil {
+			node.engine.UnsubscribeSlot(slot.Topic, slot.Subscription)
+		}
+	}
+}
+
+// resume sets up the subscriptions removed by suspend again and flushes buffered signals
+func (node *Node) resume() error {
+	for _, service := range node.serviceList() {
+		if err := node.AddService(service); err != nil {
+			return err
+		}
+	}
+	for _, slot := range node.slots {
+		if slot.Buffer == nil {
+			if err := node.AddSlot(slot); err != nil {
+				return err
+			}
+		}
+	}
+	node.flushBuffers()
+	return nil
+}
+
+// available reports whether the node passed its last health check
+func (node *Node) available() bool {
+	return node.status == 200
+}
+
 //Getting status of Node and running it
 
 func (node *Node) GetStatus(sync bool) (Status, error) {
+	if node.channel != nil {
+		node.status = node.channel.status()
+		return node.status, nil
+	}
 
-	addr := fmt.Sprintf("http://127.0.0.1:%s", node.port)
+	addr := node.baseURL
 	log.Println(addr)
-	resp, err := http.Get(addr)
+	resp, err := node.healthClient.Get(addr)
 	//log.Println(res.Body)
 	if err != nil {
 		log.Println(err)
@@ -484,16 +709,20 @@ func (node *Node) GetStatus(sync bool) (Status, error) {
 		return node.status, err
 	}
 
-	hlp := "/health_check"
-	addr = addr + hlp
-	req, err := http.Get(addr)
-
+	hlp := node.healthcheckpath
+	if hlp == "" {
+		hlp = "/health_check"
+	}
+	req, err := node.healthClient.Get(node.endpoint(hlp))
+	resp.Body.Close()
 	if err != nil {
-		node.status = Status(req.StatusCode) //unavailable
+		log.Println(err)
+		node.status = 403 //unavailable
+		return node.status, nil
 	}
-	defer resp.Body.Close()
+	defer req.Body.Close()
 
-	body, err := ioutil.ReadAll(req.Body)
+	body, err := node.readResponse(req.Body)
 	if err != nil {
 		log.Println(err)
 		return 0, err
@@ -513,40 +742,43 @@ func (node *Node) GetStatus(sync bool) (Status, error) {
 }
 
 // NodeWatchdog checks for a status of node and depending on the status
-// If dirty - calls DeleteNode
-// If unavailable - calls Stop
-// If ok - does nothing
-// This exits when node is dirty
+// If gone - calls DeleteNode
+// If unavailable or dirty - removes its subscriptions, buffered slots keep queueing
+// If ok again - restores the subscriptions and flushes buffered signals
+// This exits when node is gone
 func NodeWatchdog(node *Node) {
 	stopped := false
 	for {
-		<-time.After(time.Second * 10)
+		select {
+		case <-time.After(time.Second * 10):
+		case <-node.done:
+			return
+		}
 
 		status, err := node.GetStatus(true)
 		if err != nil {
 			log.Println(err.Error())
 			// Notify to stakeholders
-			continue
 		}
 
-		if status == 403 && !stopped {
+		if status == 404 {
+			DeleteNode(node, true, 0)
+			return
+		} else if node.IsDraining() {
+			// subscriptions stay removed until the node is deleted
+		} else if status != 200 && !stopped {
 			stopped = true
-			if err = node.Stop(); err != nil {
-				log.Println(err.Error())
-				return
-			}
+			node.suspend()
 		} else if (status == 200) && stopped {
 			stopped = false
-			if err = node.Start(); err != nil {
-				log.Println(err.Error())
-				return
-			}
-		} else if status == 404 {
-			if err = DeleteNode(node); err != nil {
+			node.status = status
+			if err = node.resume(); err != nil {
 				log.Println(err.Error())
 				return
 			}
-			return
+		} else if status == 200 {
+			// deliver signals queued again after a failed delivery
+			node.flushBuffers()
 		}
 		node.status = status
 	}
@@ -558,63 +790,152 @@ func MakeGilmour(connect string) (engine *G.Gilmour, err error) {
 	return
 }
 
+// RequestService sends the request and returns every message of the response
 func (node *Node) RequestService(serviceRequest Request) RequestResponse {
+	return node.RequestServiceStream(serviceRequest, nil)
+}
+
+// RequestServiceStream sends the request and calls emit, if not nil, with each message of the
+// response as it is received. It returns all of the messages, with the highest code.
+func (node *Node) RequestServiceStream(serviceRequest Request, emit func(RequestResponseMessage)) (output RequestResponse) {
+	output.Messages = []RequestResponseMessage{}
+	add := func(m RequestResponseMessage) {
+		output.Messages = append(output.Messages, m)
+		output.Length = len(output.Messages)
+		if m.Code > output.Code {
+			output.Code = m.Code
+		}
+		if emit != nil {
+			emit(m)
+		}
+	}
+
 	// log.Println("func RequestService serviceRequest Structure: ", serviceRequest)
+	if c := serviceRequest.Composition; c != nil {
+		var errs ValidationErrors
+		if serviceRequest.Topic != "" {
+			errs.add("topic", "cannot be combined with composition")
+		}
+		c.validate(&errs, "composition")
+		if err := errs.err(); err != nil {
+			add(errorMessage(err, 400))
+			return
+		}
+	}
+	for _, topic := range serviceRequest.Topics() {
+		if err := node.authorizeTopic(ActionPublish, topic); err != nil {
+			add(errorMessage(err, PolicyDeniedCode))
+			return
+		}
+	}
 	message := Message{}
 	message.Data = serviceRequest.Message
 	message.HandlerPath = node.port
+	message.ReplyMeta = replyMetaVersion
 	//Handler Path to be set
-	req := node.engine.NewRequest(serviceRequest.Topic)
-	resp, err := req.Execute(G.NewMessage().SetData(message))
-	if err != nil {
-		log.Println("Error running service request: ", err)
-		return RequestResponse{}
-	}
-	output := RequestResponse{}
-	if err := resp.Next().GetData(&output); err != nil {
-		log.Println("Error receiving response: ", err)
+	if serviceRequest.Composition != nil {
+		node.executeComposition(serviceRequest.Composition, message, add)
+	} else {
+		node.execute(node.engine.NewRequest(serviceRequest.Topic), message, add)
 	}
 	log.Println("Resp message: ", output)
-	return output
+	return
+}
+
+// PublishSignal publishes data on topic as a signal from the node and returns the sender id
+func (node *Node) PublishSignal(topic string, data interface{}) (string, error) {
+	if err := node.authorizeTopic(ActionPublish, topic); err != nil {
+		return "", err
+	}
+	message := Message{}
+	message.Data = data
+	message.HandlerPath = node.port
+	return node.engine.Signal(topic, G.NewMessage().SetData(message))
+}
+
+func errorMessage(err error, code int) RequestResponseMessage {
+	return RequestResponseMessage{Data: map[string]string{"error": err.Error()}, Code: code}
 }
 
 //Get node details returns the details of the said node id
 func GetNodeDetails(id string) (NodeDetailsReq, error) {
 	nm := GetNodeMap()
 	node, err := nm.Get(NodeID(id))
-	rep := NodeDetailsReq{}
 	if err != nil {
-		return rep, err
+		return NodeDetailsReq{}, err
 	}
+	return node.Details(), nil
+}
+
+// Details returns the node's registration, subscriptions, status and metrics
+func (node *Node) Details() (rep NodeDetailsReq) {
 	rep.Identifier = node.id
 	rep.Port = node.port
+	rep.URL = node.baseURL
+	rep.Socket = node.socket
+	rep.Metrics = node.metrics.Snapshot()
+	rep.Draining = node.IsDraining()
+	rep.InFlight = node.InFlight()
 	rep.HealthCheckPath = node.healthcheckpath
-	rep.Services = node.services
+	rep.Services = node.serviceList()
 	rep.Slots = node.slots
-	if node.status == 200 {
-		rep.Status = "ok"
-	} else if node.status == 404 {
-		rep.Status = "unavailable"
-	} else {
-		rep.Status = "dirty"
+	rep.Status = node.StatusString()
+	rep.Owner = node.owner
+	rep.Labels = node.labels
+	rep.TLS = node.tls.redacted()
+	rep.NodeRateLimits = node.RateLimits()
+	rep.BodyLimits = node.bodyLimits
+	rep.Transport = node.Transport()
+	return
+}
+
+// StatusString returns the node status as documented: "ok", "unavailable" or "dirty"
+func (node *Node) StatusString() string {
+	switch node.status {
+	case 200:
+		return "ok"
+	case 403, 404:
+		return "unavailable"
 	}
-	return rep, nil
+	return "dirty"
 }
 
-func CreateNode(nodeReq *NodeReq, engine *G.Gilmour) (*Node, error) {
+// newNode sets up the parts of a node which do not depend on how it is reached
+func newNode(nodeReq *NodeReq, engine *G.Gilmour) (*Node, error) {
 	node := new(Node)
 	node.engine = engine
 	node.id = NodeID(uniqueNodeID(50))
-	node.healthcheckpath = nodeReq.HealthCheckPath
-	node.port = nodeReq.Port
-	node.services = make(ServiceMap)
+	node.labels = nodeReq.Labels
+	node.secret = newNodeSecret()
+	node.bodyLimits = GetBodyLimits()
+	if err := node.SetRateLimits(nodeReq.NodeRateLimits); err != nil {
+		return nil, err
+	}
+	node.metrics = new(NodeMetrics)
+	node.done = make(chan struct{})
 	node.services = nodeReq.Services
 	node.slots = nodeReq.Slots
 	if node.engine == nil {
 		log.Println("Engine is nil")
 	}
+	return node, nil
+}
+
+func CreateNode(nodeReq *NodeReq, engine *G.Gilmour) (*Node, error) {
+	if err := nodeReq.Validate(); err != nil {
+		return nil, err
+	}
+	node, err := newNode(nodeReq, engine)
+	if err != nil {
+		return nil, err
+	}
+	node.healthcheckpath = nodeReq.HealthCheckPath
+	node.port = string(nodeReq.Port)
+	node.baseURL = nodeReq.baseURL()
+	node.socket = nodeReq.Socket
+	node.tls = nodeReq.TLS
+	node.client, node.healthClient = newNodeClients(nodeReq, node.metrics)
 
-	var err error
 	node.status, err = node.GetStatus(true)
 	if err != nil {
 		log.Printf("Cannot get status of a node: %+v", err)
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited is returned when a publish or dispatch is over its rate limit
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimit is a token bucket: Rate calls per second on average, with bursts of up to Burst
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"` // default: Rate rounded up
+}
+
+func (l *RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+func validateRateLimit(errs *ValidationErrors, field string, l *RateLimit) {
+	if l == nil {
+		return
+	}
+	if l.Rate <= 0 {
+		errs.add(field+".rate", "must be greater than 0")
+	}
+	if l.Burst < 0 {
+		errs.add(field+".burst", "cannot be negative")
+	}
+}
+
+// tokenBucket enforces a RateLimit. A nil bucket allows everything.
+type tokenBucket struct {
+	sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l *RateLimit) *tokenBucket {
+	if l == nil {
+		return nil
+	}
+	return &tokenBucket{limit: *l, tokens: l.burst(), last: time.Now()}
+}
+
+// take removes a token. If none is left it returns how long until one will be.
+func (b *tokenBucket) take() (ok bool, retryAfter time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// refilled reports whether the bucket is full again at now, so that it is no different
+// from a new one
+func (b *tokenBucket) refilled(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.burst()
+}
+
+// RateLimitError is returned with the time after which the call may be retried
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+// TopicRateLimit limits publishes to every topic matching Topic, where * matches anything.
+// Each matching topic has its own bucket, shared by all nodes.
+type TopicRateLimit struct {
+	Topic string `json:"topic"`
+	RateLimit
+
+	pattern *regexp.Regexp
+}
+
+// topicSweepInterval is how often buckets of topics which are no longer published to are removed
+const topicSweepInterval = time.Minute
+
+var topicLimits struct {
+	sync.Mutex
+	rules   []TopicRateLimit
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// LoadTopicRateLimits reads a JSON array of topic rate limits. The first matching entry applies.
+func LoadTopicRateLimits(path string) ([]TopicRateLimit, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var limits []TopicRateLimit
+	if err = json.Unmarshal(data, &limits); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return limits, nil
+}
+
+// SetTopicRateLimits replaces the per topic limits and resets their buckets
+func SetTopicRateLimits(limits []TopicRateLimit) error {
+	errs := ValidationErrors{}
+	for i := range limits {
+		field := fmt.Sprintf("[%d]", i)
+		if limits[i].Topic == "" {
+			errs.add(field+".topic", "required")
+		}
+		validateRateLimit(&errs, field, &limits[i].RateLimit)
+		limits[i].pattern = topicPattern(limits[i].Topic)
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	topicLimits.Lock()
+	defer topicLimits.Unlock()
+	topicLimits.rules = limits
+	topicLimits.buckets = make(map[string]*tokenBucket)
+	return nil
+}
+
+func topicBucket(topic string) *tokenBucket {
+	topicLimits.Lock()
+	defer topicLimits.Unlock()
+	sweepTopicBuckets(time.Now())
+	if b, ok := topicLimits.buckets[topic]; ok {
+		return b
+	}
+	var b *tokenBucket
+	for i := range topicLimits.rules {
+		if rule := &topicLimits.rules[i]; rule.pattern.MatchString(topic) {
+			b = newTokenBucket(&rule.RateLimit)
+			break
+		}
+	}
+	if b != nil {
+		topicLimits.buckets[topic] = b
+	}
+	return b
+}
+
+// sweepTopicBuckets removes the buckets which have refilled, at most once per
+// topicSweepInterval, so that a bucket is only kept while its topic is busy.
+// Called with topicLimits locked
+func sweepTopicBuckets(now time.Time) {
+	if now.Sub(topicLimits.swept) < topicSweepInterval {
+		return
+	}
+	topicLimits.swept = now
+	for topic, b := range topicLimits.buckets {
+		if b.refilled(now) {
+			delete(topicLimits.buckets, topic)
+		}
+	}
+}
+
+// NodeRateLimits are a node's limits on its own publishes and on calls to its handlers
+type NodeRateLimits struct {
+	Publish  *RateLimit `json:"rate_limit"`
+	Dispatch *RateLimit `json:"dispatch_rate_limit"`
+}
+
+// nodeLimiters holds the buckets for a node's NodeRateLimits
+type nodeLimiters struct {
+	sync.RWMutex
+	limits   NodeRateLimits
+	publish  *tokenBucket
+	dispatch *tokenBucket
+}
+
+// SetRateLimits replaces the node's limits. Nil limits are removed.
+func (node *Node) SetRateLimits(limits NodeRateLimits) error {
+	errs := ValidationErrors{}
+	validateRateLimit(&errs, "rate_limit", limits.Publish)
+	validateRateLimit(&errs, "dispatch_rate_limit", limits.Dispatch)
+	if err := errs.err(); err != nil {
+		return err
+	}
+	node.rateLimits.Lock()
+	defer node.rateLimits.Unlock()
+	node.rateLimits.limits = limits
+	node.rateLimits.publish = newTokenBucket(limits.Publish)
+	node.rateLimits.dispatch = newTokenBucket(limits.Dispatch)
+	return nil
+}
+
+// RateLimits returns the node's limits
+func (node *Node) RateLimits() NodeRateLimits {
+	node.rateLimits.RLock()
+	defer node.rateLimits.RUnlock()
+	return node.rateLimits.limits
+}
+
+// AllowPublish takes a token from the node's publish bucket, and one from the bucket of
+// each of the topics, which are those of a signal or of a Request's Topics.
+// It returns a RateLimitError if any is empty.
+func (node *Node) AllowPublish(topics ...string) error {
+	node.rateLimits.RLock()
+	publish := node.rateLimits.publish
+	node.rateLimits.RUnlock()
+	what := "publish to " + strings.Join(topics, ", ")
+	if ok, wait := publish.take(); !ok {
+		return node.rateLimited(what, wait)
+	}
+	for _, topic := range topics {
+		if ok, wait := topicBucket(topic).take(); !ok {
+			return node.rateLimited("publish to "+topic, wait)
+		}
+	}
+	return nil
+}
+
+// allowDispatch takes a token from the node's dispatch bucket
+func (node *Node) allowDispatch(what string) error {
+	node.rateLimits.RLock()
+	dispatch := node.rateLimits.dispatch
+	node.rateLimits.RUnlock()
+	if ok, wait := dispatch.take(); !ok {
+		return node.rateLimited(what, wait)
+	}
+	return nil
+}
+
+func (node *Node) rateLimited(what string, wait time.Duration) error {
+	atomic.AddInt64(&node.metrics.RateLimited, 1)
+	log.Println("Rate limited node", node.id, what)
+	return RateLimitError{RetryAfter: wait}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTopicBucketsAreSwept(t *testing.T) {
+	if err := SetTopicRateLimits([]TopicRateLimit{{Topic: "reports.*", RateLimit: RateLimit{Rate: 1000, Burst: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTopicRateLimits(nil)
+
+	for i := 0; i < 100; i++ {
+		topicBucket("reports." + strconv.Itoa(i)).take()
+	}
+	if ok, _ := topicBucket("reports.0").take(); ok {
+		t.Fatal("topic bucket was not kept while busy")
+	}
+	if n := len(topicLimits.buckets); n != 100 {
+		t.Fatalf("%d buckets", n)
+	}
+
+	// Once refilled, every bucket is the same as a new one and is removed
+	time.Sleep(5 * time.Millisecond)
+	topicLimits.Lock()
+	sweepTopicBuckets(time.Now().Add(topicSweepInterval))
+	n := len(topicLimits.buckets)
+	topicLimits.Unlock()
+	if n != 0 {
+		t.Fatalf("%d buckets after the sweep", n)
+	}
+}
+
+func TestCompositionStepsAreRateLimited(t *testing.T) {
+	if err := SetTopicRateLimits([]TopicRateLimit{{Topic: "reports.*", RateLimit: RateLimit{Rate: 0.001, Burst: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTopicRateLimits(nil)
+	node := &Node{metrics: new(NodeMetrics)}
+
+	r := Request{Composition: &Composition{Pipe: []Composition{{Topic: "fetch"}, {Topic: "reports.daily"}}}}
+	if topics := r.Topics(); len(topics) != 2 || topics[1] != "reports.daily" {
+		t.Fatalf("topics %v", topics)
+	}
+	if err := node.AllowPublish(r.Topics()...); err != nil {
+		t.Fatal(err)
+	}
+	if _, limited := node.AllowPublish(r.Topics()...).(RateLimitError); !limited {
+		t.Error("composition was not limited on its step's topic")
+	}
+	if _, limited := node.AllowPublish("reports.daily").(RateLimitError); !limited {
+		t.Error("request to the topic was not limited after the composition")
+	}
+	if err := node.AllowPublish("fetch"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 100  // milliseconds
+	defaultMaxBackoff     = 5000 // milliseconds
+)
+
+// defaultRetryOn are the handler status codes retried when a policy does not list its own
+var defaultRetryOn = []int{502, 503, 504}
+
+// RetryPolicy controls how failed dispatches to a service or slot handler are retried.
+// Connection errors are always retryable; responses are retried when their status is in RetryOn.
+type RetryPolicy struct {
+	MaxAttempts    int   `json:"max_attempts"`
+	InitialBackoff int   `json:"initial_backoff"` // milliseconds
+	MaxBackoff     int   `json:"max_backoff"`     // milliseconds
+	RetryOn        []int `json:"retry_on"`
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(status int) bool {
+	if status == 0 {
+		return true
+	}
+	retryOn := p.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, code := range retryOn {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the given retry: exponential, capped, with equal jitter
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	d := initial
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := time.Duration(d) * time.Millisecond / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func validateRetry(errs *ValidationErrors, field string, p *RetryPolicy) {
+	if p == nil {
+		return
+	}
+	if p.MaxAttempts < 0 {
+		errs.add(field+".retry.max_attempts", "cannot be negative")
+	}
+	if p.InitialBackoff < 0 {
+		errs.add(field+".retry.initial_backoff", "cannot be negative")
+	}
+	if p.MaxBackoff < 0 {
+		errs.add(field+".retry.max_backoff", "cannot be negative")
+	}
+	for _, code := range p.RetryOn {
+		if code < 100 || code > 599 {
+			errs.add(field+".retry.retry_on", "must contain http status codes")
+			break
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrServiceNotFound is returned when no service matches a removal request
+var ErrServiceNotFound = errors.New("No matching service")
+
+// ServiceMap is the original services shape, keyed by topic. It allows one service per topic
+// and is still accepted when decoding a ServiceList.
+type ServiceMap map[GilmourTopic]Service
+
+// ServiceList holds a node's services. A topic may have several services with different groups or paths
+type ServiceList []Service
+
+// UnmarshalJSON accepts the README's array of services, a single service object,
+// or the older ServiceMap object
+func (l *ServiceList) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if isSingleService(trimmed) {
+			var service Service
+			if err := json.Unmarshal(trimmed, &service); err != nil {
+				return err
+			}
+			*l = ServiceList{service}
+			return nil
+		}
+		var m ServiceMap
+		if err := json.Unmarshal(trimmed, &m); err != nil {
+			return err
+		}
+		list := make(ServiceList, 0, len(m))
+		for topic, service := range m {
+			service.Topic = topic
+			list = append(list, service)
+		}
+		*l = list
+		return nil
+	}
+	var list []Service
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func samePath(a string, b string) bool {
+	return strings.TrimLeft(a, "/") == strings.TrimLeft(b, "/")
+}
+
+// sameService reports whether a and b subscribe the same handler to the same topic and group
+func sameService(a Service, b Service) bool {
+	return a.Topic == b.Topic && a.Group == b.Group && samePath(a.Path, b.Path)
+}
+
+func serviceIndex(services []Service, service Service) int {
+	for i, s := range services {
+		if sameService(s, service) {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemoveServices unsubscribes every service on topic, or only the one at path if path is set.
+// ErrServiceNotFound is returned when nothing matched.
+func (node *Node) RemoveServices(topic GilmourTopic, path string) (removed []Service, err error) {
+	node.servicesMu.Lock()
+	defer node.servicesMu.Unlock()
+	kept := make(ServiceList, 0, len(node.services))
+	for _, service := range node.services {
+		if service.Topic == topic && (path == "" || samePath(service.Path, path)) {
+			node.engine.UnsubscribeReply(string(topic), service.Subscription)
+			removed = append(removed, service)
+			continue
+		}
+		kept = append(kept, service)
+	}
+	node.services = kept
+	if len(removed) == 0 {
+		err = ErrServiceNotFound
+	}
+	return
+}
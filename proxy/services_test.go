@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRemoveServicesWhileListing(t *testing.T) {
+	node := &Node{status: 200, metrics: new(NodeMetrics)}
+	for i := 0; i < 5; i++ {
+		if err := node.AddService(Service{Topic: GilmourTopic(fmt.Sprint("keep.", i)), Group: "g", Path: "/keep"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	churn := Service{Topic: "churn", Group: "g", Path: "/churn"}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			node.AddService(churn)
+			node.RemoveServices(churn.Topic, "")
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		services, _ := node.GetServices()
+		seen := make(map[GilmourTopic]bool)
+		for _, s := range services {
+			if seen[s.Topic] {
+				t.Fatalf("%s listed twice: %+v", s.Topic, services)
+			}
+			seen[s.Topic] = true
+		}
+		if len(services) != 5 && len(services) != 6 {
+			t.Fatalf("listed %+v", services)
+		}
+	}
+	wg.Wait()
+	if services := node.serviceList(); len(services) != 5 {
+		t.Fatalf("services left: %+v", services)
+	}
+}
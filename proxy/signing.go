@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carried by every service and slot callback to a node
+const (
+	CallbackTimestampHeader = "X-Gilmour-Timestamp"
+	CallbackSignatureHeader = "X-Gilmour-Signature"
+	callbackSignatureScheme = "v1="
+)
+
+// CallbackWindow is how old a callback's timestamp may be before a node should reject it
+const CallbackWindow = 5 * time.Minute
+
+// newNodeSecret returns the random secret a node verifies its callbacks with
+func newNodeSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CallbackSignature returns the hex HMAC-SHA256 of "<timestamp>.<body>" with the node's secret
+func CallbackSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign adds the timestamp and signature headers to a callback request
+func (node *Node) sign(req *http.Request, body []byte) {
+	if node.secret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	req.Header.Set(CallbackSignatureHeader, callbackSignatureScheme+CallbackSignature(node.secret, timestamp, body))
+}
+
+// VerifyCallback checks a callback's signature headers against the node's secret, and that
+// its timestamp is within window of now. Node SDKs written in Go can use it directly.
+func VerifyCallback(secret string, header http.Header, body []byte, window time.Duration) error {
+	timestamp := header.Get(CallbackTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Missing or malformed " + CallbackTimestampHeader)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > window || age < -window {
+		return errors.New("Callback timestamp outside the allowed window")
+	}
+	signature := header.Get(CallbackSignatureHeader)
+	if !strings.HasPrefix(signature, callbackSignatureScheme) {
+		return errors.New("Missing or malformed " + CallbackSignatureHeader)
+	}
+	expected := CallbackSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(strings.TrimPrefix(signature, callbackSignatureScheme)), []byte(expected)) {
+		return errors.New("Invalid callback signature")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNodeVerifiesCallbacks(t *testing.T) {
+	InitNodeMap()
+	dir, _, stop := serveSocket(t)
+	defer stop()
+	socket := filepath.Join(dir, "verifying.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var node *Node
+	verified := make(chan error, 1)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sum" {
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		err := VerifyCallback(node.secret, r.Header, body, CallbackWindow)
+		verified <- err
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+
+	if node, err = CreateNode(&NodeReq{Socket: socket}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if node.secret == "" || node.FormatResponse().Secret != node.secret {
+		t.Fatal("node was not given its secret")
+	}
+	if _, status, err := node.dispatch(context.Background(), "/sum", &Message{Data: 1}); err != nil || status != 200 {
+		t.Fatalf("signed dispatch: %d %v", status, err)
+	}
+	if err = <-verified; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCallbackRejects(t *testing.T) {
+	body := []byte(`{"data":1}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := func(secret string, timestamp string) http.Header {
+		h := http.Header{}
+		h.Set(CallbackTimestampHeader, timestamp)
+		h.Set(CallbackSignatureHeader, callbackSignatureScheme+CallbackSignature(secret, timestamp, body))
+		return h
+	}
+	if err := VerifyCallback("s3cret", signed("s3cret", now), body, CallbackWindow); err != nil {
+		t.Fatalf("valid callback: %v", err)
+	}
+
+	old := strconv.FormatInt(time.Now().Add(-CallbackWindow-time.Minute).Unix(), 10)
+	unsigned := http.Header{}
+	unsigned.Set(CallbackTimestampHeader, now)
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   []byte
+	}{
+		"wrong secret": {signed("other", now), body},
+		"changed body": {signed("s3cret", now), []byte(`{"data":2}`)},
+		"replayed":     {signed("s3cret", old), body},
+		"no timestamp": {http.Header{}, body},
+		"no signature": {unsigned, body},
+	} {
+		if err := VerifyCallback("s3cret", tc.header, tc.body, CallbackWindow); err == nil {
+			t.Errorf("%s: callback accepted", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveSocket runs a node handler on a unix socket in a temporary directory,
+// which is made the proxy's socket directory
+func serveSocket(t *testing.T) (dir string, socket string, stop func()) {
+	dir, err := ioutil.TempDir("", "gilmour-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetSocketDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	socket = filepath.Join(dir, "node.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/health_check", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		var m Message
+		json.NewDecoder(r.Body).Decode(&m)
+		json.NewEncoder(w).Encode(map[string]interface{}{"echo": m.Data})
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	go http.Serve(l, mux)
+	return dir, socket, func() {
+		l.Close()
+		SetSocketDir("")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSocketNodeDispatch(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.status != 200 {
+		t.Fatalf("status over the socket = %d", node.status)
+	}
+	data, status, err := node.dispatch(context.Background(), "/echo", &Message{Data: "hi"})
+	if err != nil || status != 200 {
+		t.Fatalf("dispatch: %d %v", status, err)
+	}
+	if echo := data.(map[string]interface{})["echo"]; echo != "hi" {
+		t.Errorf("echo = %v", echo)
+	}
+}
+
+func TestSocketOutsideSocketDirRejected(t *testing.T) {
+	dir, _, stop := serveSocket(t)
+	defer stop()
+
+	link := filepath.Join(dir, "docker.sock")
+	if err := os.Symlink("/var/run/docker.sock", link); err != nil {
+		t.Fatal(err)
+	}
+	for _, socket := range []string{"/var/run/docker.sock", filepath.Join(dir, "..", "other.sock"), link, dir} {
+		if err := (&NodeReq{Socket: socket}).Validate(); err == nil {
+			t.Errorf("socket %s accepted", socket)
+		}
+	}
+
+	SetSocketDir("")
+	if err := (&NodeReq{Socket: filepath.Join(dir, "node.sock")}).Validate(); err == nil {
+		t.Error("socket accepted without a socket directory")
+	}
+}
+
+func TestSocketIsNotRedirectedAfterValidation(t *testing.T) {
+	InitNodeMap()
+	dir, socket, stop := serveSocket(t)
+	defer stop()
+	outside, err := ioutil.TempDir("", "gilmour-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	other := filepath.Join(outside, "other.sock")
+	l, err := net.Listen("unix", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request %s reached the socket outside the socket directory", r.URL.Path)
+	}))
+
+	link := filepath.Join(dir, "link.sock")
+	if err = os.Symlink(socket, link); err != nil {
+		t.Fatal(err)
+	}
+	node, err := CreateNode(&NodeReq{Socket: link}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the link is not followed again, the socket it resolved to is dialled
+	node.client.CloseIdleConnections()
+	os.Remove(link)
+	if err = os.Symlink(other, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, err := node.dispatch(context.Background(), "/echo", &Message{}); err != nil || status != 200 {
+		t.Fatalf("dispatch after the link changed: %d %v", status, err)
+	}
+
+	// nor is a link which replaced the socket itself
+	node.client.CloseIdleConnections()
+	os.Remove(socket)
+	if err = os.Symlink(other, socket); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := node.dispatch(context.Background(), "/echo", &Message{}); err == nil {
+		t.Fatal("dispatch followed a link which replaced the socket")
+	}
+}
+
+func TestForcedDeleteReportsOK(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+
+	for _, force := range []bool{false, true} {
+		node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.begin()
+		report := DeleteNode(node, force, 0)
+		node.end()
+		if report.InFlight != 1 {
+			t.Errorf("force=%v: in_flight = %d", force, report.InFlight)
+		}
+		if force != (report.Status == "ok") {
+			t.Errorf("force=%v: status = %q", force, report.Status)
+		}
+	}
+}
+
+func TestResponseOverLimitFailsDispatch(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := node.dispatch(context.Background(), "/echo", &Message{Data: "small"}); err != nil {
+		t.Fatalf("dispatch within the limit: %v", err)
+	}
+	node.bodyLimits.Response = 16
+	if _, _, err := node.dispatch(context.Background(), "/echo", &Message{Data: "a reply longer than the limit"}); err == nil || !strings.Contains(err.Error(), ErrBodyTooLarge.Error()) {
+		t.Fatalf("dispatch over the limit: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often certificate files are checked for changes, at most
+const reloadInterval = time.Second
+
+// NodeTLS configures HTTPS to a node. Certificates are given as PEM, or as files in the
+// proxy's node TLS directory, which are reloaded when they change.
+type NodeTLS struct {
+	CA         string `json:"ca,omitempty"`          // PEM CA bundle the node's certificate must chain to. default: system roots
+	Cert       string `json:"cert,omitempty"`        // PEM client certificate for nodes which require mutual TLS
+	Key        string `json:"key,omitempty"`         // PEM key of the client certificate
+	CAFile     string `json:"ca_file,omitempty"`     // file alternatives to CA, Cert and Key
+	CertFile   string `json:"cert_file,omitempty"`   //
+	KeyFile    string `json:"key_file,omitempty"`    //
+	ServerName string `json:"server_name,omitempty"` // name the node's certificate must be valid for. default: the url's host
+}
+
+// redacted returns the settings without the client key, for node details
+func (t *NodeTLS) redacted() *NodeTLS {
+	if t == nil {
+		return nil
+	}
+	r := *t
+	if r.Key != "" {
+		r.Key = "REDACTED"
+	}
+	return &r
+}
+
+var nodeTLSDir struct {
+	sync.RWMutex
+	dir string
+}
+
+// SetNodeTLSDir configures the directory certificate files given in a node's tls settings
+// must be in. With none, nodes can only give their certificates as PEM.
+func SetNodeTLSDir(dir string) error {
+	if dir != "" {
+		var err error
+		if dir, err = resolveDir(dir); err != nil {
+			return err
+		}
+	}
+	nodeTLSDir.Lock()
+	defer nodeTLSDir.Unlock()
+	nodeTLSDir.dir = dir
+	return nil
+}
+
+func tlsFileAllowed(p string) bool {
+	nodeTLSDir.RLock()
+	defer nodeTLSDir.RUnlock()
+	return inDir(nodeTLSDir.dir, p)
+}
+
+// certFiles holds a certificate and CA bundle loaded from files or PEM. Files are loaded
+// again when a file's modification time changes; if that fails the old ones are kept.
+type certFiles struct {
+	certFile, keyFile, caFile string
+	certPEM, keyPEM, caPEM    string
+
+	sync.Mutex
+	checked time.Time
+	modTime map[string]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertFiles(certFile, keyFile, caFile string) (*certFiles, error) {
+	c := &certFiles{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certFiles) load() error {
+	modTime := make(map[string]time.Time)
+	for _, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTime[f] = info.ModTime()
+	}
+	var cert *tls.Certificate
+	switch {
+	case c.certFile != "":
+		pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	case c.certPEM != "":
+		pair, err := tls.X509KeyPair([]byte(c.certPEM), []byte(c.keyPEM))
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+	var pool *x509.CertPool
+	caPEM := []byte(c.caPEM)
+	if c.caFile != "" {
+		var err error
+		if caPEM, err = ioutil.ReadFile(c.caFile); err != nil {
+			return err
+		}
+	}
+	if len(caPEM) > 0 {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("CA bundle: no certificates found")
+		}
+	}
+	c.modTime, c.cert, c.pool = modTime, cert, pool
+	return nil
+}
+
+// changed reports whether any file's modification time differs from when it was loaded
+func (c *certFiles) changed() bool {
+	for f, t := range c.modTime {
+		if info, err := os.Stat(f); err == nil && !info.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the certificate and CA pool, reloading them if the files changed
+func (c *certFiles) current() (*tls.Certificate, *x509.CertPool) {
+	c.Lock()
+	defer c.Unlock()
+	if time.Since(c.checked) >= reloadInterval {
+		c.checked = time.Now()
+		if c.changed() {
+			if err := c.load(); err != nil {
+				log.Println("Keeping old certificates, reload failed:", err)
+			} else {
+				log.Println("Reloaded certificates from", c.certFile, c.caFile)
+			}
+		}
+	}
+	return c.cert, c.pool
+}
+
+// ServerTLSConfig returns the TLS config for the proxy's listener. When clientCAFile is set,
+// clients must present a certificate signed by one of its CAs. All files are reloaded when
+// they change.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	files, err := newCertFiles(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := files.current()
+			return cert, nil
+		},
+	}
+	if clientCAFile != "" {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, pool := files.current()
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = pool
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			return c, nil
+		}
+	}
+	return config, nil
+}
+
+// certificates loads the node's client certificate and CA bundle
+func (t *NodeTLS) certificates() (*certFiles, error) {
+	c := &certFiles{
+		certFile: t.CertFile, keyFile: t.KeyFile, caFile: t.CAFile,
+		certPEM: t.Cert, keyPEM: t.Key, caPEM: t.CA,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientConfig returns the TLS config for dispatches and health checks to a node at baseURL
+func (t *NodeTLS) clientConfig(baseURL string) (*tls.Config, error) {
+	files, err := t.certificates()
+	if err != nil {
+		return nil, err
+	}
+	serverName := t.ServerName
+	if serverName == "" {
+		if u, err := url.Parse(baseURL); err == nil {
+			serverName = u.Hostname()
+		}
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if t.CertFile != "" || t.Cert != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := files.current()
+			return cert, nil
+		}
+	}
+	if t.CAFile != "" || t.CA != "" {
+		// The CA bundle can change while pooled connections are open, so verification is done
+		// here against the current pool instead of a fixed RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := files.current()
+			return verifyChain(rawCerts, pool, serverName)
+		}
+	}
+	return config, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("Node presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{Roots: roots, DNSName: serverName, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+func validateTLS(errs *ValidationErrors, field string, nodeReq *NodeReq) {
+	t := nodeReq.TLS
+	if nodeReq.Socket != "" {
+		errs.add(field, "cannot be combined with socket")
+		return
+	}
+	if u, err := url.Parse(nodeReq.URL); nodeReq.URL != "" && err == nil && u.Scheme != "https" {
+		errs.add("url", "scheme must be https when tls is set")
+	}
+	valid := true
+	check := func(ok bool, name string, message string) {
+		if !ok {
+			errs.add(field+"."+name, message)
+			valid = false
+		}
+	}
+	check(t.Cert == "" || t.CertFile == "", "cert", "cannot be combined with cert_file")
+	check(t.CA == "" || t.CAFile == "", "ca", "cannot be combined with ca_file")
+	check((t.Cert == "") == (t.Key == ""), "key", "cert and key must be given together")
+	check((t.CertFile == "") == (t.KeyFile == ""), "key_file", "cert_file and key_file must be given together")
+	// Files are checked against the directory before they are read, so that callers
+	// can neither use other certificates on the proxy's host nor find out which exist
+	for _, f := range []struct{ name, path string }{{"ca_file", t.CAFile}, {"cert_file", t.CertFile}, {"key_file", t.KeyFile}} {
+		check(f.path == "" || tlsFileAllowed(f.path), f.name, "must be in the proxy's node TLS directory")
+	}
+	if !valid {
+		return
+	}
+	if _, err := t.certificates(); err != nil {
+		errs.add(field, err.Error())
+	}
+}
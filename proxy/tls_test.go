@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate and its key as PEM
+func testCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "node"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func tlsErrors(t *NodeTLS) ValidationErrors {
+	var errs ValidationErrors
+	validateTLS(&errs, "tls", &NodeReq{URL: "https://node.example", TLS: t})
+	return errs
+}
+
+func TestNodeTLSInlinePEM(t *testing.T) {
+	cert, key := testCert(t)
+	if errs := tlsErrors(&NodeTLS{CA: cert, Cert: cert, Key: key}); len(errs) > 0 {
+		t.Fatalf("inline PEM rejected: %v", errs)
+	}
+	if errs := tlsErrors(&NodeTLS{Cert: cert}); len(errs) == 0 {
+		t.Fatal("cert without key accepted")
+	}
+	if errs := tlsErrors(&NodeTLS{CA: "not a certificate"}); len(errs) == 0 {
+		t.Fatal("invalid CA accepted")
+	}
+	details := (&NodeTLS{Cert: cert, Key: key}).redacted()
+	if details.Key == key {
+		t.Fatal("node details include the client key")
+	}
+}
+
+func TestNodeTLSFilesMustBeInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gilmour-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := testCert(t)
+	certFile, keyFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	ioutil.WriteFile(certFile, []byte(cert), 0600)
+	ioutil.WriteFile(keyFile, []byte(key), 0600)
+
+	// Without a directory no files are allowed, existing or not, and the
+	// errors are the same so they do not tell which files exist
+	SetNodeTLSDir("")
+	existing := tlsErrors(&NodeTLS{CertFile: certFile, KeyFile: keyFile})
+	missing := tlsErrors(&NodeTLS{CertFile: certFile + ".missing", KeyFile: keyFile + ".missing"})
+	if len(existing) == 0 || len(existing) != len(missing) {
+		t.Fatalf("files outside the directory: %v, %v", existing, missing)
+	}
+	for i := range existing {
+		if existing[i] != missing[i] {
+			t.Fatalf("errors differ for existing and missing files: %v, %v", existing[i], missing[i])
+		}
+		if strings.Contains(existing[i].Message, dir) {
+			t.Fatalf("error reveals the path: %v", existing[i])
+		}
+	}
+
+	if err = SetNodeTLSDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetNodeTLSDir("")
+	if errs := tlsErrors(&NodeTLS{CertFile: certFile, KeyFile: keyFile}); len(errs) > 0 {
+		t.Fatalf("files in the directory rejected: %v", errs)
+	}
+	outside := filepath.Join(dir, "..", filepath.Base(dir)+"-outside.crt")
+	ioutil.WriteFile(outside, []byte(cert), 0600)
+	defer os.Remove(outside)
+	if errs := tlsErrors(&NodeTLS{CAFile: outside}); len(errs) == 0 {
+		t.Fatal("file outside the directory accepted")
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// socketHost is the placeholder host used in URLs for nodes reached over a unix socket
+const socketHost = "unix"
+
+// ClientConfig tunes the HTTP client every node is health checked and dispatched to with
+type ClientConfig struct {
+	MaxIdleConnsPerNode   int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration // 0 for none; dispatches are still bounded by dispatchTimeout
+	HealthCheckTimeout    time.Duration // limit for each health check request
+	DispatchTimeout       time.Duration // limit for a dispatch whose service or slot has no timeout
+}
+
+var clientConfig = struct {
+	sync.RWMutex
+	ClientConfig
+}{
+	ClientConfig: ClientConfig{
+		MaxIdleConnsPerNode: 64,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         5 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		HealthCheckTimeout:  5 * time.Second,
+		DispatchTimeout:     60 * time.Second,
+	},
+}
+
+// SetClientConfig replaces the client settings used for nodes registered from now on
+func SetClientConfig(c ClientConfig) {
+	clientConfig.Lock()
+	defer clientConfig.Unlock()
+	clientConfig.ClientConfig = c
+}
+
+// GetClientConfig returns the current client settings
+func GetClientConfig() ClientConfig {
+	clientConfig.RLock()
+	defer clientConfig.RUnlock()
+	return clientConfig.ClientConfig
+}
+
+// dispatchTimeout is how long a dispatch to a handler with timeout (seconds, 0 for none) may take
+func dispatchTimeout(timeout int) time.Duration {
+	if timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return GetClientConfig().DispatchTimeout
+}
+
+// newNodeClients returns the pooled clients used for dispatches and health checks to the node.
+// They share connections; health checks are limited to HealthCheckTimeout. Every new
+// connection is counted in metrics.
+func newNodeClients(nodeReq *NodeReq, metrics *NodeMetrics) (client *http.Client, health *http.Client) {
+	c := GetClientConfig()
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: c.KeepAlive}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if nodeReq.Socket != "" {
+			// Only the socket which was validated is dialled, and only while it still
+			// resolves to itself, so a symlink changed since cannot redirect dispatches
+			if resolved, ok := resolveSocket(nodeReq.socketPath); !ok || resolved != nodeReq.socketPath {
+				return nil, fmt.Errorf("socket %s is no longer %s", nodeReq.Socket, nodeReq.socketPath)
+			}
+			network, addr = "unix", nodeReq.socketPath
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			metrics.connOpened()
+		}
+		return conn, err
+	}
+	transport := &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          c.MaxIdleConnsPerNode,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerNode,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+	}
+	if nodeReq.TLS != nil {
+		var err error
+		if transport.TLSClientConfig, err = nodeReq.TLS.clientConfig(nodeReq.baseURL()); err != nil {
+			log.Println("Cannot set up TLS to node:", err)
+		}
+	}
+	return &http.Client{Transport: transport}, &http.Client{Transport: transport, Timeout: c.HealthCheckTimeout}
+}
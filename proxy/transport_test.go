@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDispatchToHangingHandlerTimesOut(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, status, _, err := node.dispatchWithRetry("/hang", &Message{}, nil, 1)
+	if err == nil || status != 0 {
+		t.Fatalf("dispatch to a hanging handler: %d %v", status, err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Fatalf("dispatch took %s with a 1s timeout", took)
+	}
+}
+
+func TestDispatchTimeoutDefault(t *testing.T) {
+	if d := dispatchTimeout(7); d != 7*time.Second {
+		t.Errorf("dispatchTimeout(7) = %s", d)
+	}
+	if d := dispatchTimeout(0); d != GetClientConfig().DispatchTimeout || d <= 0 {
+		t.Errorf("dispatchTimeout(0) = %s", d)
+	}
+}
+
+func TestRetriesShareTheTimeout(t *testing.T) {
+	InitNodeMap()
+	_, socket, stop := serveSocket(t)
+	defer stop()
+
+	node, err := CreateNode(&NodeReq{Socket: socket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	retry := &RetryPolicy{MaxAttempts: 5}
+	_, _, attempts, err := node.dispatchWithRetry("/hang", &Message{}, retry, 1)
+	if err == nil || attempts != 1 {
+		t.Fatalf("hanging handler: %d attempts, %v", attempts, err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Fatalf("retries took %s with a 1s timeout", took)
+	}
+}
+
+func TestReplyMeta(t *testing.T) {
+	data := map[string]interface{}{"sum": 3.0}
+	if got := withReplyMeta(0, data, 2); !reflect.DeepEqual(got, data) {
+		t.Fatalf("reply to a non-proxy requester = %v", got)
+	}
+	wrapped, err := json.Marshal(withReplyMeta(replyMetaVersion, data, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m RequestResponseMessage
+	json.Unmarshal(wrapped, &m.Data)
+	m.unwrapReplyMeta()
+	if m.Attempts != 2 || !reflect.DeepEqual(m.Data, data) {
+		t.Fatalf("unwrapped reply = %+v", m)
+	}
+
+	if string(wrapped) != `{"data":{"sum":3},"proxy_reply":{"version":1,"attempts":2}}` {
+		t.Fatalf("reply to a proxy = %s", wrapped)
+	}
+
+	plain := RequestResponseMessage{Data: map[string]interface{}{"data": 1.0}}
+	plain.unwrapReplyMeta()
+	if plain.Attempts != 0 || plain.Data.(map[string]interface{})["data"] != 1.0 {
+		t.Fatalf("reply without meta changed: %+v", plain)
+	}
+	unknown := RequestResponseMessage{Data: map[string]interface{}{"data": 1.0, replyMetaKey: map[string]interface{}{"version": 2.0, "attempts": 2.0}}}
+	unknown.unwrapReplyMeta()
+	if unknown.Attempts != 0 || len(unknown.Data.(map[string]interface{})) != 2 {
+		t.Fatalf("reply with an unknown meta version changed: %+v", unknown)
+	}
+}
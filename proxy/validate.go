@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a single invalid field in a node, service or slot definition
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is returned when a definition has one or more invalid fields
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field string, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+// err returns nil when nothing was collected, so callers can return it directly
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func isWildcard(topic string) bool {
+	return strings.Contains(topic, "*")
+}
+
+func validatePort(errs *ValidationErrors, field string, port string) {
+	if port == "" {
+		errs.add(field, "required")
+		return
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		errs.add(field, "must be a number between 1 and 65535")
+	}
+}
+
+func validateService(errs *ValidationErrors, field string, service Service) {
+	if service.Topic == "" {
+		errs.add(field+".topic", "required")
+	} else if isWildcard(string(service.Topic)) {
+		errs.add(field+".topic", "cannot be a wildcard")
+	}
+	if service.Group == "" {
+		errs.add(field+".group", "required")
+	}
+	if service.Path == "" {
+		errs.add(field+".path", "required")
+	}
+	if service.Timeout < 0 {
+		errs.add(field+".timeout", "cannot be negative")
+	}
+	validateConcurrency(errs, field, service.MaxConcurrency, service.MaxQueue)
+	validateRetry(errs, field, service.Retry)
+}
+
+func validateSlot(errs *ValidationErrors, field string, slot Slot) {
+	if slot.Topic == "" {
+		errs.add(field+".topic", "required")
+	}
+	if slot.Path == "" {
+		errs.add(field+".path", "required")
+	}
+	if slot.Timeout < 0 {
+		errs.add(field+".timeout", "cannot be negative")
+	}
+	validateConcurrency(errs, field, slot.MaxConcurrency, slot.MaxQueue)
+	validateRetry(errs, field, slot.Retry)
+	validateBuffer(errs, field, slot.Buffer)
+}
+
+func validateConcurrency(errs *ValidationErrors, field string, maxConcurrency int, maxQueue int) {
+	if maxConcurrency < 0 {
+		errs.add(field+".max_concurrency", "cannot be negative")
+	}
+	if maxQueue < 0 {
+		errs.add(field+".max_queue", "cannot be negative")
+	}
+	if maxQueue > 0 && maxConcurrency == 0 {
+		errs.add(field+".max_queue", "requires max_concurrency")
+	}
+}
+
+// Validate checks a node registration request before any subscriptions are made
+func (nodeReq *NodeReq) Validate() error {
+	errs := ValidationErrors{}
+	switch {
+	case nodeReq.Socket != "" && (nodeReq.URL != "" || nodeReq.Port != ""):
+		errs.add("socket", "cannot be combined with port or url")
+	case nodeReq.Socket != "":
+		if !filepath.IsAbs(nodeReq.Socket) {
+			errs.add("socket", "must be an absolute path")
+		} else if resolved, ok := resolveSocket(nodeReq.Socket); !ok {
+			errs.add("socket", "must be in the proxy's socket directory")
+		} else {
+			nodeReq.socketPath = resolved
+		}
+	case nodeReq.URL != "":
+		validateURL(&errs, "url", nodeReq.URL)
+	default:
+		validatePort(&errs, "port", string(nodeReq.Port))
+	}
+	if nodeReq.TLS != nil {
+		validateTLS(&errs, "tls", nodeReq)
+	}
+	nodeReq.validateOptions(&errs)
+	return errs.err()
+}
+
+// validateOptions checks everything in the request except how the node is reached
+func (nodeReq *NodeReq) validateOptions(errs *ValidationErrors) {
+	validateRateLimit(errs, "rate_limit", nodeReq.Publish)
+	validateRateLimit(errs, "dispatch_rate_limit", nodeReq.Dispatch)
+	validateServiceList(errs, nodeReq.Services)
+	for i, slot := range nodeReq.Slots {
+		validateSlot(errs, fmt.Sprintf("slots[%d]", i), slot)
+	}
+}
+
+func validateServiceList(errs *ValidationErrors, services ServiceList) {
+	for i, service := range services {
+		field := fmt.Sprintf("services[%d]", i)
+		validateService(errs, field, service)
+		if serviceIndex(services[:i], service) != -1 {
+			errs.add(field, "duplicate of an earlier service with the same topic, group and path")
+		}
+	}
+}
+
+// ValidateServices checks every service in the list
+func ValidateServices(services ServiceList) error {
+	errs := ValidationErrors{}
+	validateServiceList(&errs, services)
+	return errs.err()
+}
+
+// ValidateService checks a single service definition
+func ValidateService(service Service) error {
+	errs := ValidationErrors{}
+	validateService(&errs, "service", service)
+	return errs.err()
+}
+
+// ValidateSlot checks a single slot definition
+func ValidateSlot(slot Slot) error {
+	errs := ValidationErrors{}
+	validateSlot(&errs, "slot", slot)
+	return errs.err()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fields returns the fields of err, which must be nil or ValidationErrors
+func fields(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("%T is not ValidationErrors: %v", err, err)
+	}
+	var fields []string
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
+
+func TestNodeReqValidate(t *testing.T) {
+	service := Service{Topic: "sum", Group: "math", Path: "/sum"}
+	for _, tc := range []struct {
+		name   string
+		req    NodeReq
+		fields []string
+	}{
+		{"valid", NodeReq{Port: "8080", Services: ServiceList{service}, Slots: []Slot{{Topic: "log.*", Path: "/log"}}}, nil},
+		{"no port", NodeReq{}, []string{"port"}},
+		{"port not a number", NodeReq{Port: "http"}, []string{"port"}},
+		{"port 0", NodeReq{Port: "0"}, []string{"port"}},
+		{"port too large", NodeReq{Port: "65536"}, []string{"port"}},
+		{"negative port", NodeReq{Port: "-1"}, []string{"port"}},
+		{"socket with port", NodeReq{Port: "8080", Socket: "/tmp/node.sock"}, []string{"socket"}},
+		{"relative socket", NodeReq{Socket: "node.sock"}, []string{"socket"}},
+		{"invalid service", NodeReq{Port: "8080", Services: ServiceList{{Topic: "sum.*", Path: "/sum"}}}, []string{"services[0].topic", "services[0].group"}},
+		{"invalid slot", NodeReq{Port: "8080", Slots: []Slot{{Path: "/log"}, {Topic: "log", Path: "/log", Timeout: -1}}}, []string{"slots[0].topic", "slots[1].timeout"}},
+		{"invalid rate limit", NodeReq{Port: "8080", NodeRateLimits: NodeRateLimits{Publish: &RateLimit{}}}, []string{"rate_limit.rate"}},
+	} {
+		if got := fields(t, tc.req.Validate()); !reflect.DeepEqual(got, tc.fields) {
+			t.Errorf("%s: invalid fields %v, want %v", tc.name, got, tc.fields)
+		}
+	}
+}
+
+func TestValidateServiceList(t *testing.T) {
+	sum := Service{Topic: "sum", Group: "math", Path: "/sum"}
+	for _, tc := range []struct {
+		name     string
+		services ServiceList
+		fields   []string
+	}{
+		{"valid", ServiceList{sum, {Topic: "sum", Group: "math", Path: "/sum/v2"}, {Topic: "sum", Group: "stats", Path: "/sum"}}, nil},
+		{"empty", ServiceList{{}}, []string{"services[0].topic", "services[0].group", "services[0].path"}},
+		{"wildcard topic", ServiceList{{Topic: "sum.*", Group: "math", Path: "/sum"}}, []string{"services[0].topic"}},
+		{"duplicate", ServiceList{sum, {Topic: "sum", Group: "math", Path: "sum"}}, []string{"services[1]"}},
+		{"negative timeout", ServiceList{{Topic: "sum", Group: "math", Path: "/sum", Timeout: -1}}, []string{"services[0].timeout"}},
+		{"queue without concurrency", ServiceList{{Topic: "sum", Group: "math", Path: "/sum", MaxQueue: 1}}, []string{"services[0].max_queue"}},
+		{"negative concurrency", ServiceList{{Topic: "sum", Group: "math", Path: "/sum", MaxConcurrency: -1}}, []string{"services[0].max_concurrency"}},
+		{"bad retry", ServiceList{{Topic: "sum", Group: "math", Path: "/sum", Retry: &RetryPolicy{RetryOn: []int{42}}}}, []string{"services[0].retry.retry_on"}},
+	} {
+		if got := fields(t, ValidateServices(tc.services)); !reflect.DeepEqual(got, tc.fields) {
+			t.Errorf("%s: invalid fields %v, want %v", tc.name, got, tc.fields)
+		}
+	}
+}
+
+func TestValidateSlot(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		slot   Slot
+		fields []string
+	}{
+		{"valid", Slot{Topic: "log", Path: "/log"}, nil},
+		{"wildcard topic", Slot{Topic: "log.*", Group: "audit", Path: "/log"}, nil},
+		{"empty", Slot{}, []string{"slot.topic", "slot.path"}},
+		{"negative timeout", Slot{Topic: "log", Path: "/log", Timeout: -5}, []string{"slot.timeout"}},
+		{"negative queue", Slot{Topic: "log", Path: "/log", MaxConcurrency: 1, MaxQueue: -1}, []string{"slot.max_queue"}},
+		{"negative buffer", Slot{Topic: "log", Path: "/log", Buffer: &BufferPolicy{MaxSize: -1, MaxAge: -1}}, []string{"slot.buffer.max_size", "slot.buffer.max_age"}},
+	} {
+		if got := fields(t, ValidateSlot(tc.slot)); !reflect.DeepEqual(got, tc.fields) {
+			t.Errorf("%s: invalid fields %v, want %v", tc.name, got, tc.fields)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 15 * time.Second
+	wsPongWait     = 45 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsRegisterWait = 30 * time.Second
+)
+
+// wsStream carries channel frames as WebSocket text messages
+type wsStream struct {
+	conn *websocket.Conn
+}
+
+func (s wsStream) SendMsg(m interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(m)
+}
+
+func (s wsStream) RecvMsg(m interface{}) error {
+	if err := s.conn.ReadJSON(m); err != nil {
+		return err
+	}
+	return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+}
+
+// ServeWebSocket runs the node channel over a WebSocket connection, closing it when done.
+// The connection is pinged to keep it alive and closed when the node stops answering.
+func ServeWebSocket(conn *websocket.Conn, cred *Credential, register func(*NodeReq) (*Node, error)) {
+	defer conn.Close()
+	conn.SetReadLimit(GetBodyLimits().Publish)
+	conn.SetReadDeadline(time.Now().Add(wsRegisterWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	ServeChannel(wsStream{conn}, cred, register)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"./proxy"
+	"net/http"
+)
+
+// route is one endpoint of the control and publish API. The same table registers the
+// handlers and generates the OpenAPI document, so the two cannot drift apart.
+type route struct {
+	Method   string
+	Path     string
+	Handler  http.HandlerFunc
+	Legacy   http.HandlerFunc // used on the unversioned route when its response differs
+	Summary  string
+	Query    []string
+	Request  interface{}
+	Response interface{}
+}
+
+// Response bodies which are not proxy types
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// validationErrorResponse is the 400 response to an invalid request
+type validationErrorResponse struct {
+	Error  string                 `json:"error"`
+	Fields proxy.ValidationErrors `json:"fields"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type drainResponse struct {
+	Status   string `json:"status"`
+	InFlight int64  `json:"in_flight"`
+	Deleted  bool   `json:"deleted"`
+}
+
+type subscriptionResponse struct {
+	Status  string                     `json:"status"`
+	Results []proxy.SubscriptionResult `json:"results"`
+}
+
+type removeResponse struct {
+	Status  string `json:"status"`
+	Removed int    `json:"removed"`
+}
+
+type servicesResponse struct {
+	Services []proxy.Service `json:"services"`
+}
+
+type slotsResponse struct {
+	Slots []proxy.Slot `json:"slots"`
+}
+
+type deadLettersResponse struct {
+	DeadLetters []proxy.DeadLetter `json:"dead_letters"`
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
+
+var routes = []route{
+	{Method: "POST", Path: "/nodes", Handler: createNodeHandlerV1, Legacy: createNodeHandler,
+		Summary: "Register a node", Request: proxy.NodeReq{}, Response: proxy.CreateNodeResponseV1{}},
+	{Method: "GET", Path: "/nodes/{id}", Handler: getNodeDetailsV1, Legacy: getNodeDetails,
+		Summary: "Get details of a node", Response: proxy.NodeDetailsV1{}},
+	{Method: "DELETE", Path: "/nodes/{id}", Handler: deleteNodeHandler,
+		Summary: "Remove a node", Query: []string{"force", "timeout"}, Response: proxy.DeleteReport{}},
+	{Method: "POST", Path: "/nodes/{id}/drain", Handler: drainNodeHandler,
+		Summary: "Drain a node", Query: []string{"timeout", "delete"}, Response: drainResponse{}},
+	{Method: "PUT", Path: "/nodes/{id}/rate_limits", Handler: setRateLimitsHandler,
+		Summary: "Set a node's rate limits", Request: proxy.NodeRateLimits{}, Response: proxy.NodeRateLimits{}},
+	{Method: "GET", Path: "/ws", Handler: webSocketHandler,
+		Summary: "Connect a node over a WebSocket", Response: proxy.Frame{}},
+
+	{Method: "POST", Path: "/request/{id}", Handler: RequestServiceHandler,
+		Summary: "Send a request", Query: []string{"stream"}, Request: proxy.Request{}, Response: proxy.RequestResponse{}},
+	{Method: "GET", Path: "/request/{id}/{reqid}", Handler: getAsyncRequestHandler,
+		Summary: "Poll an asynchronous request", Response: proxy.AsyncRequest{}},
+
+	{Method: "GET", Path: "/nodes/{id}/services", Handler: getServicesHandler,
+		Summary: "List service subscriptions", Response: servicesResponse{}},
+	{Method: "POST", Path: "/nodes/{id}/services", Handler: addServicesHandler,
+		Summary: "Add service subscriptions", Request: []proxy.Service{}, Response: subscriptionResponse{}},
+	{Method: "DELETE", Path: "/nodes/{id}/services", Handler: removeServicesHandler,
+		Summary: "Remove service subscriptions", Query: []string{"topic", "path"}, Response: removeResponse{}},
+
+	{Method: "POST", Path: "/nodes/{id}/slots", Handler: addSlotsHandler,
+		Summary: "Add slot subscriptions", Request: []proxy.Slot{}, Response: subscriptionResponse{}},
+	{Method: "GET", Path: "/nodes/{id}/slots", Handler: getSlotsHandler,
+		Summary: "List slot subscriptions", Response: slotsResponse{}},
+	{Method: "DELETE", Path: "/nodes/{id}/slots", Handler: removeSlotsHandler,
+		Summary: "Remove slot subscriptions", Query: []string{"topic", "path"}, Response: statusResponse{}},
+
+	{Method: "GET", Path: "/nodes/{id}/deadletters", Handler: getDeadLettersHandler,
+		Summary: "List dead letters", Response: deadLettersResponse{}},
+	{Method: "POST", Path: "/nodes/{id}/deadletters/replay", Handler: replayDeadLettersHandler,
+		Summary: "Replay dead letters", Query: []string{"id"}, Response: replayResponse{}},
+	{Method: "DELETE", Path: "/nodes/{id}/deadletters", Handler: purgeDeadLettersHandler,
+		Summary: "Purge dead letters", Query: []string{"id"}, Response: statusResponse{}},
+}
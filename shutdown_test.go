@@ -0,0 +1,88 @@
+package main
+
+import (
+	"./proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOnSIGTERM(t *testing.T) {
+	proxy.InitNodeMap()
+	node, err := proxy.CreateChannelNode(&proxy.NodeReq{}, nil, proxy.TransportWebSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a control request which is still running when the signal arrives
+	started := make(chan struct{})
+	release := make(chan struct{})
+	drainedDuringRequest := make(chan bool, 1)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		drainedDuringRequest <- node.IsDraining()
+		w.Write([]byte("done"))
+	})}
+	go srv.Serve(lis)
+	url := "http://" + lis.Addr().String()
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-started
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(stop, srv, nil, 5*time.Second)
+		close(stopped)
+	}()
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	// new control requests are refused while the one in progress finishes
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("still accepting control requests")
+		}
+	}
+	close(release)
+	if <-drainedDuringRequest {
+		t.Error("node drained before the control request finished")
+	}
+	if body := <-response; body != "done" {
+		t.Errorf("control request in progress got %q", body)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if !node.IsDraining() {
+		t.Error("node was not drained")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"./proxy"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Streaming formats for POST /request/:id
+const (
+	streamNDJSON = "ndjson"
+	streamSSE    = "sse"
+)
+
+// streamSummary ends a streamed response
+type streamSummary struct {
+	Done   bool `json:"done"`
+	Code   int  `json:"code"`
+	Length int  `json:"length"`
+}
+
+// streamFormat returns the streaming format asked for with ?stream= or the Accept header,
+// or "" for a single JSON response
+func streamFormat(req *http.Request) string {
+	switch req.URL.Query().Get("stream") {
+	case streamNDJSON:
+		return streamNDJSON
+	case streamSSE:
+		return streamSSE
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return streamSSE
+	case strings.Contains(accept, "application/x-ndjson"):
+		return streamNDJSON
+	}
+	return ""
+}
+
+// streamResponse writes each response message as soon as it is received, followed by a summary.
+// NDJSON writes one JSON object per line; SSE sends "message" events and a final "done" event.
+func streamResponse(w http.ResponseWriter, node *proxy.Node, serviceRequest proxy.Request, format string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		logWriterError(w, fmt.Errorf("Streaming is not supported on this connection"))
+		return
+	}
+	if format == streamSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(event string, v interface{}) {
+		js, err := json.Marshal(v)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if format == streamSSE {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", js)
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+		flusher.Flush()
+	}
+	response := node.RequestServiceStream(serviceRequest, func(m proxy.RequestResponseMessage) {
+		write("message", m)
+	})
+	write("done", streamSummary{Done: true, Code: response.Code, Length: response.Length})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"./proxy"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serveWebSocket runs a /ws endpoint behind authMiddleware which sends the caller's principal
+func serveWebSocket(t *testing.T) (string, func()) {
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cred := credential(req)
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		principal := ""
+		if cred != nil {
+			principal = cred.Principal
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(principal))
+	}))
+	s := httptest.NewServer(handler)
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws", s.Close
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	url, stop := serveWebSocket(t)
+	defer stop()
+	wsOrigins = []string{"https://app.example.com"}
+	defer func() { wsOrigins = nil }()
+
+	for origin, allowed := range map[string]bool{
+		"":                         true,
+		"https://app.example.com":  true,
+		"https://evil.example.com": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if (err == nil) != allowed {
+			t.Errorf("origin %q: %v", origin, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestWebSocketSubprotocolCredentials(t *testing.T) {
+	url, stop := serveWebSocket(t)
+	defer stop()
+	keys, err := ioutil.TempFile("", "gilmour-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keys.Name())
+	keys.WriteString("browser k3y\n")
+	keys.Close()
+	auth, err := proxy.NewAPIKeyAuth(keys.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetAuthenticators(auth)
+	defer proxy.SetAuthenticators()
+
+	if _, _, err = websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("connected without a credential")
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{wsSubprotocol, wsAPIKeyPrefix + "k3y"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != wsSubprotocol {
+		t.Errorf("subprotocol = %q", conn.Subprotocol())
+	}
+	if _, principal, err := conn.ReadMessage(); err != nil || string(principal) != "browser" {
+		t.Errorf("principal = %q, %v", principal, err)
+	}
+}